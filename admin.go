@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinimumAdminTokenLength ensures the administrative token cannot be easily guessed.
+	MinimumAdminTokenLength = 32
+
+	// QueryDeviceAccountsStatement lists every account registered with a device ID, as a console may register several.
+	QueryDeviceAccountsStatement = `SELECT account_id FROM userbase WHERE device_id = $1`
+)
+
+// AdminResult represents the response to an administrative request.
+type AdminResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Bans   []Ban  `json:"bans,omitempty"`
+}
+
+// adminServeMux serves metrics, health checks and administration upon AdminAddress.
+func adminServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readinessHandler)
+	mux.Handle("/admin/", adminHandler())
+	return mux
+}
+
+// adminHandler serves administrative operations under /admin/.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/rotate-token", rotateTokenHandler)
+	mux.HandleFunc("/admin/bans", bansHandler)
+	return requireAdmin(mux)
+}
+
+// requireAdmin only permits requests bearing the configured AdminToken.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminToken := settings().AdminToken
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) != 1 {
+			logger.Warn("rejected administrative request", "remote_addr", r.RemoteAddr, "url", r.URL.String())
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdmin(w, http.StatusUnauthorized, AdminResult{Status: "error", Error: "invalid admin token"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rotateTokenHandler replaces the device token of the console given by device_id,
+// such as after it was leaked. The console may only obtain another by signing a challenge within SyncRegistration.
+func rotateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAdmin(w, http.StatusMethodNotAllowed, AdminResult{Status: "error", Error: "use POST"})
+		return
+	}
+
+	deviceId, err := strconv.ParseInt(r.FormValue("device_id"), 10, 64)
+	if err != nil {
+		writeAdmin(w, http.StatusBadRequest, AdminResult{Status: "error", Error: "device_id must be a number"})
+		return
+	}
+
+	accountIds, err := queryDeviceAccounts(r.Context(), deviceId)
+	if err != nil {
+		logger.Error("error querying accounts", "err", err)
+		writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+		return
+	}
+	if len(accountIds) == 0 {
+		writeAdmin(w, http.StatusNotFound, AdminResult{Status: "error", Error: "no console is registered with this device ID"})
+		return
+	}
+
+	// Tokens are unique, so every account is issued its own. Nobody learns them, so the previous ones are simply invalidated.
+	for _, accountId := range accountIds {
+		_, md5DeviceToken, err := issueDeviceToken()
+		if err != nil {
+			writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: err.Error()})
+			return
+		}
+
+		_, err = db.Exec(r.Context(), UpdateTokenStatement, md5DeviceToken, now().UTC(), accountId)
+		if err != nil {
+			logger.Error("error executing statement", "err", err)
+			writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+			return
+		}
+	}
+
+	verifiedTokens.Invalidate(int(deviceId))
+	logger.Warn("rotated device token", "device_id", deviceId, "remote_addr", r.RemoteAddr)
+	writeAdmin(w, http.StatusOK, AdminResult{Status: "ok"})
+}
+
+// queryDeviceAccounts returns the IDs of every account registered with the given device ID.
+func queryDeviceAccounts(ctx context.Context, deviceId int64) ([]int64, error) {
+	rows, err := db.Query(ctx, QueryDeviceAccountsStatement, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accountIds []int64
+	for rows.Next() {
+		var accountId int64
+		err = rows.Scan(&accountId)
+		if err != nil {
+			return nil, err
+		}
+		accountIds = append(accountIds, accountId)
+	}
+	return accountIds, rows.Err()
+}
+
+func writeAdmin(w http.ResponseWriter, statusCode int, result AdminResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testAdminToken is configured within admin tests.
+const testAdminToken = "4dm1n-t0k3n-f0r-t3st1ng-purp0535"
+
+// adminRequest performs a request against the administrative API, returning its status and result.
+func adminRequest(t *testing.T, handler http.Handler, method string, path string, token string, form url.Values) (int, AdminResult) {
+	request := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	var result AdminResult
+	if recorder.Code != http.StatusNotFound {
+		err := json.Unmarshal(recorder.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return recorder.Code, result
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	setupTestServer(t)
+	handler := adminServeMux()
+
+	cases := []struct {
+		Name       string
+		Configured string
+		Presented  string
+		Status     int
+	}{
+		{"disabled", "", testAdminToken, http.StatusNotFound},
+		{"missing", testAdminToken, "", http.StatusUnauthorized},
+		{"wrong", testAdminToken, strings.ToUpper(testAdminToken), http.StatusUnauthorized},
+		{"valid", testAdminToken, testAdminToken, http.StatusOK},
+	}
+	for _, c := range cases {
+		config := *settings()
+		config.AdminToken = c.Configured
+		currentConfig.Store(&config)
+
+		if status, _ := adminRequest(t, handler, "GET", "/admin/bans", c.Presented, nil); status != c.Status {
+			t.Errorf("%s: status %d, expected %d", c.Name, status, c.Status)
+		}
+	}
+
+	// Metrics and health checks do not require the token.
+	for _, path := range []string{"/metrics", "/healthz"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%s: status %d", path, recorder.Code)
+		}
+	}
+}
+
+func TestAdminRotateToken(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	config.AdminToken = testAdminToken
+	currentConfig.Store(&config)
+	handler := adminServeMux()
+
+	// Another account shares the test console's device ID, and must be issued a token of its own.
+	database := newTestDatabase()
+	database.users = append(database.users, testOtherAccount)
+	db = database
+
+	cases := []struct {
+		Name     string
+		Method   string
+		DeviceId string
+		Status   int
+	}{
+		{"method", "GET", "4362227770", http.StatusMethodNotAllowed},
+		{"malformed", "POST", "wii", http.StatusBadRequest},
+		{"unregistered", "POST", "4362227772", http.StatusNotFound},
+		{"registered", "POST", "4362227770", http.StatusOK},
+	}
+	for _, c := range cases {
+		status, _ := adminRequest(t, handler, c.Method, "/admin/rotate-token", testAdminToken, url.Values{"device_id": {c.DeviceId}})
+		if status != c.Status {
+			t.Errorf("%s: status %d, expected %d", c.Name, status, c.Status)
+		}
+	}
+
+	if database.users[1].DeviceTokenHashed == testOtherAccount.DeviceTokenHashed {
+		t.Error("the other account's token was not rotated")
+	}
+	if database.users[0].DeviceTokenHashed == database.users[1].DeviceTokenHashed {
+		t.Error("both accounts were issued the same token")
+	}
+
+	// The previous token, which the conformance request presents, must no longer be accepted.
+	body, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	route := newServiceRoute()
+	route.Handle().ServeHTTP(recorder, soapRequest("ecs", "CheckDeviceStatus", body))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("rotated token was accepted with status %d", recorder.Code)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	config.AdminToken = testAdminToken
+	currentConfig.Store(&config)
+	handler := adminServeMux()
+
+	ban := url.Values{"kind": {BanSerialNumber}, "value": {"LU521023236"}, "reason": {"Cheating."}, "duration": {"72h"}}
+	steps := []struct {
+		Name   string
+		Method string
+		Form   url.Values
+		Status int
+		Bans   int
+	}{
+		{"empty", "GET", nil, http.StatusOK, 0},
+		{"invalid kind", "POST", url.Values{"kind": {"name"}, "value": {"Mii"}}, http.StatusBadRequest, 0},
+		{"invalid duration", "POST", url.Values{"kind": {BanDeviceId}, "value": {"4362227770"}, "duration": {"-1h"}}, http.StatusBadRequest, 0},
+		{"add", "POST", ban, http.StatusOK, 1},
+		{"update", "POST", ban, http.StatusOK, 1},
+		{"add permanent", "POST", url.Values{"kind": {BanDeviceId}, "value": {"4362227770"}}, http.StatusOK, 2},
+		{"lift", "DELETE", url.Values{"kind": {BanSerialNumber}, "value": {"LU521023236"}}, http.StatusOK, 1},
+		{"lift again", "DELETE", url.Values{"kind": {BanSerialNumber}, "value": {"LU521023236"}}, http.StatusNotFound, 1},
+	}
+	for _, step := range steps {
+		path := "/admin/bans"
+		form := step.Form
+		// Lifting bans is requested via the query string, as DELETE bodies are not parsed.
+		if step.Method == "DELETE" {
+			path += "?" + form.Encode()
+			form = nil
+		}
+		status, _ := adminRequest(t, handler, step.Method, path, testAdminToken, form)
+		if status != step.Status {
+			t.Errorf("%s: status %d, expected %d", step.Name, status, step.Status)
+		}
+
+		_, result := adminRequest(t, handler, "GET", "/admin/bans", testAdminToken, nil)
+		if len(result.Bans) != step.Bans {
+			t.Fatalf("%s: listed %+v, expected %d bans", step.Name, result.Bans, step.Bans)
+		}
+	}
+
+	_, result := adminRequest(t, handler, "GET", "/admin/bans", testAdminToken, nil)
+	if listed := result.Bans[0]; listed.Kind != BanDeviceId || listed.Value != "4362227770" || listed.Expires != nil || !listed.Created.Equal(testTime) {
+		t.Errorf("listed %+v", listed)
+	}
+}
+
+func TestBansAfterAuthentication(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	config.AdminToken = testAdminToken
+	currentConfig.Store(&config)
+	admin := adminServeMux()
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	valid, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.unauthorized.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(body []byte) (int, string) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, soapRequest("ecs", "CheckDeviceStatus", body))
+		return recorder.Code, recorder.Body.String()
+	}
+
+	// Credentials verified prior to the ban are cached.
+	if status, _ := send(valid); status != http.StatusOK {
+		t.Fatalf("status %d before ban", status)
+	}
+	ban := url.Values{"kind": {BanDeviceId}, "value": {"4362227770"}, "reason": {"Cheating."}}
+	if status, _ := adminRequest(t, admin, "POST", "/admin/bans", testAdminToken, ban); status != http.StatusOK {
+		t.Fatalf("status %d adding ban", status)
+	}
+
+	// Those merely claiming to be the console learn nothing of its ban.
+	if status, body := send(invalid); status != http.StatusUnauthorized || strings.Contains(body, "Cheating.") {
+		t.Errorf("unauthenticated request got status %d: %s", status, body)
+	}
+	// The console itself is refused, and told why.
+	for _, step := range []string{"uncached", "cached"} {
+		if status, body := send(valid); status != http.StatusInternalServerError || !strings.Contains(body, "Cheating.") {
+			t.Errorf("%s: banned console got status %d: %s", step, status, body)
+		}
+	}
+
+	lift := url.Values{"kind": {BanDeviceId}, "value": {"4362227770"}}
+	if status, _ := adminRequest(t, admin, "DELETE", "/admin/bans?"+lift.Encode(), testAdminToken, nil); status != http.StatusOK {
+		t.Fatalf("status %d lifting ban", status)
+	}
+	if status, _ := send(valid); status != http.StatusOK {
+		t.Errorf("status %d after lifting ban", status)
+	}
+}
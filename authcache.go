@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+)
+
+// authCacheMaxEntries bounds memory used by the authentication cache.
+const authCacheMaxEntries = 100000
+
+// authCacheEntry records credentials verified against the database for a console, and any ban applying to it.
+type authCacheEntry struct {
+	AccountId int64
+	TokenHash string
+	Issued    time.Time
+	Ban       *Ban
+	Expires   time.Time
+}
+
+// authCache remembers recently verified credentials, as the Shop Channel
+// sends many authenticated requests in quick succession for every page.
+type authCache struct {
+	mu      sync.Mutex
+	entries map[int]authCacheEntry
+}
+
+// verifiedTokens caches credentials by device ID.
+var verifiedTokens = newAuthCache()
+
+func newAuthCache() *authCache {
+	return &authCache{entries: map[int]authCacheEntry{}}
+}
+
+// Lookup returns when the given token was issued, and any ban still in effect,
+// if it was recently verified for this console. Hashes are compared in constant time.
+func (c *authCache) Lookup(deviceId int, accountId int64, tokenHash string) (time.Time, *Ban, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[deviceId]
+	c.mu.Unlock()
+
+	current := now()
+	if !ok || current.After(entry.Expires) || entry.AccountId != accountId {
+		return time.Time{}, nil, false
+	}
+	if subtle.ConstantTimeCompare([]byte(entry.TokenHash), []byte(tokenHash)) != 1 {
+		return time.Time{}, nil, false
+	}
+
+	if entry.Ban != nil && entry.Ban.Expires != nil && !entry.Ban.Expires.After(current) {
+		return entry.Issued, nil, true
+	}
+	return entry.Issued, entry.Ban, true
+}
+
+// Store remembers verified credentials, and the ban applying to them if any, for the configured AuthCacheTTL.
+func (c *authCache) Store(deviceId int, accountId int64, tokenHash string, issued time.Time, ban *Ban) {
+	ttl := settings().AuthCacheTTL.Duration
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := now()
+	if len(c.entries) >= authCacheMaxEntries {
+		for id, entry := range c.entries {
+			if current.After(entry.Expires) {
+				delete(c.entries, id)
+			}
+		}
+		// Should everything remain valid, start afresh rather than growing without bound.
+		if len(c.entries) >= authCacheMaxEntries {
+			c.entries = make(map[int]authCacheEntry)
+		}
+	}
+
+	c.entries[deviceId] = authCacheEntry{
+		AccountId: accountId,
+		TokenHash: tokenHash,
+		Issued:    issued,
+		Ban:       ban,
+		Expires:   current.Add(ttl),
+	}
+}
+
+// Invalidate forgets credentials for a console, such as after its token changes.
+func (c *authCache) Invalidate(deviceId int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, deviceId)
+}
+
+// Clear forgets all credentials, such as after bans change, as it is unknown which consoles they apply to.
+func (c *authCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[int]authCacheEntry)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Error codes reported to banned consoles, which the Shop Channel displays alongside our reason.
+	ECSBannedErrorCode = 618
+	IASBannedErrorCode = 928
+
+	// QueryBanStatement finds an active ban for the given identifiers, or those registered to the device.
+	// Permanent bans are preferred, followed by those lasting longest.
+	QueryBanStatement = `SELECT b.kind, b.value, COALESCE(b.reason, ''), b.expires, b.created FROM bans b
+	WHERE (b.expires IS NULL OR b.expires > $1) AND (
+		(b.kind = 'device_id' AND b.value = $2) OR
+		(b.kind = 'account_id' AND b.value = $3) OR
+		(b.kind = 'serial_number' AND b.value = $4) OR
+		(b.kind = 'device_code' AND b.value = $5) OR
+		EXISTS (SELECT 1 FROM userbase u WHERE u.device_id = $6 AND (
+			(b.kind = 'account_id' AND b.value = u.account_id::text) OR
+			(b.kind = 'serial_number' AND b.value = u.serial_number) OR
+			(b.kind = 'device_code' AND b.value = u.device_code::text))))
+	ORDER BY b.expires DESC NULLS FIRST LIMIT 1`
+	ListBansStatement = `SELECT kind, value, COALESCE(reason, ''), expires, created FROM bans
+	WHERE expires IS NULL OR expires > $1 ORDER BY created`
+	AddBanStatement = `INSERT INTO bans (kind, value, reason, expires, created) VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+	ON CONFLICT (kind, value) DO UPDATE SET reason = EXCLUDED.reason, expires = EXCLUDED.expires, created = EXCLUDED.created`
+	RemoveBanStatement = `DELETE FROM bans WHERE kind = $1 AND value = $2`
+)
+
+// Kinds of identifier a ban may apply to.
+const (
+	BanDeviceId     = "device_id"
+	BanSerialNumber = "serial_number"
+	BanDeviceCode   = "device_code"
+	BanAccountId    = "account_id"
+)
+
+// Ban refuses service to a console or account.
+type Ban struct {
+	Kind    string     `json:"kind"`
+	Value   string     `json:"value"`
+	Reason  string     `json:"reason,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Created time.Time  `json:"created"`
+}
+
+// normaliseBanValue validates an identifier of the given kind, returning it as stored within bans.
+func normaliseBanValue(kind string, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case BanDeviceId, BanDeviceCode, BanAccountId:
+		number, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a number", kind)
+		}
+		return strconv.FormatUint(number, 10), nil
+	case BanSerialNumber:
+		if value == "" || len(value) > 20 {
+			return "", errors.New("serial_number must be between 1 and 20 characters")
+		}
+		return strings.ToUpper(value), nil
+	}
+
+	return "", fmt.Errorf("kind must be one of %s, %s, %s or %s", BanDeviceId, BanSerialNumber, BanDeviceCode, BanAccountId)
+}
+
+// findBan returns the active ban applying to a console, or nil if it is not banned.
+// Any identifier may be empty if unknown; those registered to the device are always considered.
+func findBan(ctx context.Context, deviceId int, accountId string, serialNumber string, deviceCode string) (*Ban, error) {
+	var ban Ban
+	row := db.QueryRow(ctx, QueryBanStatement, now().UTC(), strconv.Itoa(deviceId), accountId, strings.ToUpper(serialNumber), deviceCode, deviceId)
+	err := row.Scan(&ban.Kind, &ban.Value, &ban.Reason, &ban.Expires, &ban.Created)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &ban, nil
+}
+
+// bannedErrorCode returns the error code banned consoles are told of for the given service.
+func bannedErrorCode(service string) int {
+	if service == "ias" {
+		return IASBannedErrorCode
+	}
+	return ECSBannedErrorCode
+}
+
+// refuseBanned responds to a banned console with its ban. The reason and expiry are only disclosed
+// to consoles which have authenticated, as others may merely claim a banned console's identifiers.
+func refuseBanned(e *Envelope, service string, ban *Ban, authenticated bool) {
+	bannedTotal.WithLabelValues(ban.Kind).Inc()
+	e.logger.Warn("refused banned console", "kind", ban.Kind, "value", ban.Value)
+
+	reason := "This console has been banned from the Wii Shop Channel."
+	if !authenticated {
+		e.Error(bannedErrorCode(service), reason, errors.New("banned"))
+		return
+	}
+
+	if ban.Reason != "" {
+		reason += " Reason: " + ban.Reason
+	}
+	if ban.Expires != nil {
+		reason += " The ban is lifted on " + ban.Expires.UTC().Format("2006-01-02 15:04") + " UTC."
+	}
+
+	e.Error(bannedErrorCode(service), reason, fmt.Errorf("banned by %s", ban.Kind))
+}
+
+// bansHandler lists active bans upon GET, adds or updates a ban upon POST, and lifts one upon DELETE.
+// Bans are identified by kind and value. Expiry is given either as an RFC 3339 time via expires,
+// or relative to now via duration; without either, a ban is permanent.
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		listBans(w, r)
+		return
+	case "POST", "DELETE":
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeAdmin(w, http.StatusMethodNotAllowed, AdminResult{Status: "error", Error: "use GET, POST or DELETE"})
+		return
+	}
+
+	kind := r.FormValue("kind")
+	value, err := normaliseBanValue(kind, r.FormValue("value"))
+	if err != nil {
+		writeAdmin(w, http.StatusBadRequest, AdminResult{Status: "error", Error: err.Error()})
+		return
+	}
+
+	if r.Method == "DELETE" {
+		result, err := db.Exec(r.Context(), RemoveBanStatement, kind, value)
+		if err != nil {
+			logger.Error("error executing statement", "err", err)
+			writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+			return
+		}
+		if result.RowsAffected() == 0 {
+			writeAdmin(w, http.StatusNotFound, AdminResult{Status: "error", Error: "no such ban"})
+			return
+		}
+
+		verifiedTokens.Clear()
+		logger.Warn("lifted ban", "kind", kind, "value", value, "remote_addr", r.RemoteAddr)
+		writeAdmin(w, http.StatusOK, AdminResult{Status: "ok"})
+		return
+	}
+
+	current := now().UTC()
+	var expires *time.Time
+	if raw := r.FormValue("expires"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeAdmin(w, http.StatusBadRequest, AdminResult{Status: "error", Error: "expires must be an RFC 3339 time"})
+			return
+		}
+		parsed = parsed.UTC()
+		expires = &parsed
+	} else if raw := r.FormValue("duration"); raw != "" {
+		duration, err := time.ParseDuration(raw)
+		if err != nil || duration <= 0 {
+			writeAdmin(w, http.StatusBadRequest, AdminResult{Status: "error", Error: "duration must be positive, such as 72h"})
+			return
+		}
+		until := current.Add(duration)
+		expires = &until
+	}
+
+	_, err = db.Exec(r.Context(), AddBanStatement, kind, value, r.FormValue("reason"), expires, current)
+	if err != nil {
+		logger.Error("error executing statement", "err", err)
+		writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+		return
+	}
+
+	// Bans of consoles already verified would otherwise only apply once their credentials leave the cache.
+	verifiedTokens.Clear()
+	logger.Warn("added ban", "kind", kind, "value", value, "expires", expires, "remote_addr", r.RemoteAddr)
+	writeAdmin(w, http.StatusOK, AdminResult{Status: "ok"})
+}
+
+func listBans(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(r.Context(), ListBansStatement, now().UTC())
+	if err != nil {
+		logger.Error("error executing statement", "err", err)
+		writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+		return
+	}
+	defer rows.Close()
+
+	bans := []Ban{}
+	for rows.Next() {
+		var ban Ban
+		err = rows.Scan(&ban.Kind, &ban.Value, &ban.Reason, &ban.Expires, &ban.Created)
+		if err != nil {
+			logger.Error("error scanning ban", "err", err)
+			writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+			return
+		}
+		bans = append(bans, ban)
+	}
+	if rows.Err() != nil {
+		logger.Error("error reading bans", "err", rows.Err())
+		writeAdmin(w, http.StatusInternalServerError, AdminResult{Status: "error", Error: "failed to execute db operation"})
+		return
+	}
+
+	writeAdmin(w, http.StatusOK, AdminResult{Status: "ok", Bans: bans})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange represents a captured request and the response we gave it.
+type Exchange struct {
+	Time     time.Time   `json:"time"`
+	Duration float64     `json:"duration_ms"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Host     string      `json:"host"`
+	Headers  http.Header `json:"headers"`
+	Body     string      `json:"body"`
+
+	Status          int         `json:"status"`
+	ResponseHeaders http.Header `json:"response_headers"`
+	Response        string      `json:"response"`
+}
+
+// DefaultRedactedElements hold credentials, or identify a console, and are redacted from captures by default.
+var DefaultRedactedElements = []string{"DeviceToken", "SerialNumber", "OriginalSerialNumber", "DeviceCode", "DeviceCert", "Signature"}
+
+// redactedHeaders are never written to captures.
+var redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// tokenRedactor removes device tokens from documents we log.
+var tokenRedactor = NewRedactor([]string{"DeviceToken"})
+
+// Redactor replaces the contents of chosen elements, and sensitive headers, with REDACTED.
+type Redactor struct {
+	elements *regexp.Regexp
+}
+
+// NewRedactor returns a Redactor for the named elements, matched regardless of prefix.
+func NewRedactor(elements []string) *Redactor {
+	if len(elements) == 0 {
+		return &Redactor{}
+	}
+
+	names := make([]string, len(elements))
+	for i, element := range elements {
+		names[i] = regexp.QuoteMeta(element)
+	}
+	alternatives := strings.Join(names, "|")
+	return &Redactor{
+		elements: regexp.MustCompile(`(<(?:\w+:)?(?:` + alternatives + `)>)[^<]*(</(?:\w+:)?(?:` + alternatives + `)>)`),
+	}
+}
+
+// Document replaces the contents of all chosen elements within a document.
+func (r *Redactor) Document(document string) string {
+	if r.elements == nil {
+		return document
+	}
+
+	return r.elements.ReplaceAllString(document, "${1}REDACTED${2}")
+}
+
+// Headers returns a copy of the given headers, with sensitive values replaced.
+func (r *Redactor) Headers(headers http.Header) http.Header {
+	redacted := headers.Clone()
+	for _, name := range redactedHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+
+	return redacted
+}
+
+// redactTokens replaces all device tokens within a document.
+func redactTokens(document string) string {
+	return tokenRedactor.Document(document)
+}
+
+// CaptureWriter writes exchanges as JSON lines to files within a directory,
+// rotating once a file exceeds its maximum size.
+type CaptureWriter struct {
+	Directory string
+	MaxSize   int64
+	MaxFiles  int
+
+	// Redactor is applied to every exchange, unless nil.
+	Redactor *Redactor
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewCaptureWriter prepares the given directory for captures, redacting exchanges with redactor unless nil.
+func NewCaptureWriter(directory string, maxSize int64, maxFiles int, redactor *Redactor) (*CaptureWriter, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureWriter{
+		Directory: directory,
+		MaxSize:   maxSize,
+		MaxFiles:  maxFiles,
+		Redactor:  redactor,
+	}, nil
+}
+
+// Write appends an exchange to the current capture file.
+func (c *CaptureWriter) Write(exchange Exchange) error {
+	if c.Redactor != nil {
+		exchange.Headers = c.Redactor.Headers(exchange.Headers)
+		exchange.ResponseHeaders = c.Redactor.Headers(exchange.ResponseHeaders)
+		exchange.Body = c.Redactor.Document(exchange.Body)
+		exchange.Response = c.Redactor.Document(exchange.Response)
+	}
+
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil || c.size+int64(len(line)) > c.MaxSize {
+		err = c.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	written, err := c.file.Write(line)
+	c.size += int64(written)
+	return err
+}
+
+// rotate closes the current capture file, opens a new one, and removes the oldest files beyond MaxFiles.
+func (c *CaptureWriter) rotate() error {
+	if c.file != nil {
+		c.file.Close()
+	}
+
+	name := filepath.Join(c.Directory, fmt.Sprintf("capture-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000")))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		c.file = nil
+		return err
+	}
+	c.file = file
+	c.size = 0
+
+	if c.MaxFiles <= 0 {
+		return nil
+	}
+
+	// Timestamps within names allow sorting chronologically.
+	existing, err := filepath.Glob(filepath.Join(c.Directory, "capture-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(existing)
+	for len(existing) > c.MaxFiles {
+		os.Remove(existing[0])
+		existing = existing[1:]
+	}
+
+	return nil
+}
+
+// Close closes the current capture file.
+func (c *CaptureWriter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// capturingResponseWriter retains the status and body written to a response.
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *capturingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *capturingResponseWriter) Write(contents []byte) (int, error) {
+	w.body.Write(contents)
+	return w.ResponseWriter.Write(contents)
+}
+
+// Capture wraps a handler, recording every exchange to the writer.
+func (c *CaptureWriter) Capture(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is retained as the handler reads it, so any size limits continue to apply.
+		var body bytes.Buffer
+		r.Body = io.NopCloser(io.TeeReader(r.Body, &body))
+
+		recorder := &capturingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+		duration := time.Since(start)
+
+		err := c.Write(Exchange{
+			Time:     start.UTC(),
+			Duration: float64(duration.Microseconds()) / 1000,
+			Method:   r.Method,
+			URL:      r.URL.String(),
+			Host:     r.Host,
+			Headers:  r.Header,
+			Body:     body.String(),
+
+			Status:          recorder.status,
+			ResponseHeaders: w.Header(),
+			Response:        recorder.body.String(),
+		})
+		if err != nil {
+			logger.Error("failed to capture exchange", "err", err)
+		}
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactor(t *testing.T) {
+	redactor := NewRedactor(DefaultRedactedElements)
+
+	cases := []struct {
+		Name     string
+		Document string
+		Expected string
+	}{
+		{
+			"prefixed",
+			"<ecs:DeviceToken>WT-ef02b5e6e0cb2a603d9afef4f048f747</ecs:DeviceToken><ecs:AccountId>123456789</ecs:AccountId>",
+			"<ecs:DeviceToken>REDACTED</ecs:DeviceToken><ecs:AccountId>123456789</ecs:AccountId>",
+		},
+		{
+			"unprefixed",
+			"<DeviceToken>kR7ooWUFOJqWL8UKMoR9E</DeviceToken><DeviceCode>1234567890123516</DeviceCode>",
+			"<DeviceToken>REDACTED</DeviceToken><DeviceCode>REDACTED</DeviceCode>",
+		},
+		{
+			"identifiers",
+			"<ias:SerialNumber>LU521023236</ias:SerialNumber><ias:DeviceCert>AAECAw==</ias:DeviceCert><ias:Signature>BAUGBw==</ias:Signature>",
+			"<ias:SerialNumber>REDACTED</ias:SerialNumber><ias:DeviceCert>REDACTED</ias:DeviceCert><ias:Signature>REDACTED</ias:Signature>",
+		},
+		{
+			"similarly named",
+			"<OriginalSerialNumber>LU521023236</OriginalSerialNumber><DeviceTokenExpired>false</DeviceTokenExpired>",
+			"<OriginalSerialNumber>REDACTED</OriginalSerialNumber><DeviceTokenExpired>false</DeviceTokenExpired>",
+		},
+		{
+			"empty",
+			"<DeviceToken></DeviceToken>",
+			"<DeviceToken>REDACTED</DeviceToken>",
+		},
+	}
+	for _, c := range cases {
+		if actual := redactor.Document(c.Document); actual != c.Expected {
+			t.Errorf("%s: redacted to %s", c.Name, actual)
+		}
+	}
+
+	if document := "<SerialNumber>LU521023236</SerialNumber>"; NewRedactor(nil).Document(document) != document {
+		t.Error("redactor without elements altered a document")
+	}
+	if actual := redactTokens("<SerialNumber>LU521023236</SerialNumber><DeviceToken>secret</DeviceToken>"); actual != "<SerialNumber>LU521023236</SerialNumber><DeviceToken>REDACTED</DeviceToken>" {
+		t.Errorf("tokens redacted to %s", actual)
+	}
+
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	headers.Set("SOAPAction", "urn:ecs.wsapi.broadon.com/CheckDeviceStatus")
+	redacted := redactor.Headers(headers)
+	if redacted.Get("Authorization") != "REDACTED" || redacted.Get("SOAPAction") != headers.Get("SOAPAction") {
+		t.Errorf("headers redacted to %v", redacted)
+	}
+	if headers.Get("Authorization") != "Bearer secret" {
+		t.Error("original headers were altered")
+	}
+}
+
+// readCaptures returns all exchanges captured within directory, and how many files they span.
+func readCaptures(t *testing.T, directory string) ([]Exchange, int) {
+	paths, err := filepath.Glob(filepath.Join(directory, "capture-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exchanges []Exchange
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var exchange Exchange
+			err = json.Unmarshal(scanner.Bytes(), &exchange)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exchanges = append(exchanges, exchange)
+		}
+		file.Close()
+	}
+
+	return exchanges, len(paths)
+}
+
+func TestCaptureWriterRedacts(t *testing.T) {
+	directory := t.TempDir()
+	capture, err := NewCaptureWriter(directory, 1024*1024, 10, NewRedactor(DefaultRedactedElements))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+
+	err = capture.Write(Exchange{
+		Headers:  http.Header{"Cookie": {"session=secret"}},
+		Body:     "<ias:SerialNumber>LU521023236</ias:SerialNumber>",
+		Response: "<DeviceToken>kR7ooWUFOJqWL8UKMoR9E</DeviceToken>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges, _ := readCaptures(t, directory)
+	if len(exchanges) != 1 {
+		t.Fatalf("captured %d exchanges", len(exchanges))
+	}
+	for _, secret := range []string{"secret", "LU521023236", "kR7ooWUFOJqWL8UKMoR9E"} {
+		line, _ := json.Marshal(exchanges[0])
+		if strings.Contains(string(line), secret) {
+			t.Errorf("captured %q", secret)
+		}
+	}
+}
+
+func TestCaptureWriterRotates(t *testing.T) {
+	directory := t.TempDir()
+	const maxFiles = 3
+	capture, err := NewCaptureWriter(directory, 1024, maxFiles, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+
+	// Each exchange fills more than half a file, so that every one rotates.
+	for i := 0; i < 6; i++ {
+		err = capture.Write(Exchange{
+			Time: time.Unix(int64(i), 0).UTC(),
+			Body: strings.Repeat("x", 600),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Files are named after when they were opened.
+		time.Sleep(time.Millisecond)
+	}
+
+	exchanges, files := readCaptures(t, directory)
+	if files != maxFiles {
+		t.Errorf("%d files were kept, expected %d", files, maxFiles)
+	}
+	if len(exchanges) != maxFiles {
+		t.Fatalf("%d exchanges were kept, expected %d", len(exchanges), maxFiles)
+	}
+	for i, exchange := range exchanges {
+		if expected := time.Unix(int64(6-maxFiles+i), 0).UTC(); !exchange.Time.Equal(expected) {
+			t.Errorf("exchange %d is from %v, expected the newest", i, exchange.Time)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	// ChallengeLength matches that of SharedChallenge, the most consoles accept.
+	ChallengeLength = 11
+
+	// InvalidChallengeErrorCode is reported if a console does not return a challenge it was issued.
+	InvalidChallengeErrorCode = 929
+
+	// MaxChallengesPerDevice limits how many unexpired challenges a console may hold at once.
+	MaxChallengesPerDevice = 8
+
+	// PurgeChallengesStatement removes expired challenges of a console before it is issued another,
+	// along with all but the newest $3, so that it holds at most MaxChallengesPerDevice.
+	PurgeChallengesStatement = `DELETE FROM challenges WHERE device_id = $1 AND (expires <= $2 OR challenge NOT IN (SELECT challenge FROM challenges WHERE device_id = $1 ORDER BY expires DESC LIMIT $3))`
+	IssueChallengeStatement  = `INSERT INTO challenges (device_id, challenge, expires) VALUES ($1, $2, $3)`
+	// ConsumeChallengeStatement removes a challenge once returned, so that it cannot be replayed.
+	ConsumeChallengeStatement = `DELETE FROM challenges WHERE device_id = $1 AND challenge = $2 AND expires > $3`
+)
+
+// issueChallenge returns the challenge for a console to return within Register or SyncRegistration.
+// Unless strict, this is always SharedChallenge.
+func issueChallenge(e *Envelope) (string, error) {
+	config := settings().Challenges
+	if !config.Strict {
+		return SharedChallenge, nil
+	}
+
+	// Anyone may request a challenge for any console, so those previously issued remain valid
+	// until they expire, rather than allowing others to replace the one a console is about to return.
+	// Only the newest are kept, so that doing so repeatedly cannot grow the table without bound.
+	challenge, err := RandString(ChallengeLength)
+	if err != nil {
+		return "", err
+	}
+	current := now().UTC()
+	_, err = db.Exec(ctx, PurgeChallengesStatement, e.DeviceId(), current, MaxChallengesPerDevice-1)
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(ctx, IssueChallengeStatement, e.DeviceId(), challenge, current.Add(config.Lifetime.Duration))
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// verifyChallenge ensures that, if strict, the console has returned an unexpired challenge issued to it.
+// Where its device certificate is known to have been issued by the MS, it must also sign the challenge with
+// the key the certificate was issued for; otherwise deviceCert is nil, and any signature is disregarded,
+// as it cannot be verified. It reports whether a signature was verified, proving the console is who it claims to be.
+func verifyChallenge(e *Envelope, deviceCert []byte) (bool, error) {
+	if !settings().Challenges.Strict {
+		return false, nil
+	}
+
+	challenge, err := getKey(e.doc, "Challenge")
+	if err != nil {
+		return false, errors.New("no challenge was returned")
+	}
+	result, err := db.Exec(ctx, ConsumeChallengeStatement, e.DeviceId(), challenge, now().UTC())
+	if err != nil {
+		return false, err
+	}
+	if result.RowsAffected() == 0 {
+		return false, errors.New("challenge was not issued to this console, or has expired")
+	}
+
+	encoded, err := getKey(e.doc, "Signature")
+	if err != nil && deviceCert != nil {
+		// Returning a challenge alone only proves GetChallenge was called, which anyone may do.
+		return false, errors.New("challenge must be signed, as this console's device certificate is known")
+	} else if err != nil || deviceCert == nil {
+		return false, nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false, errors.New("challenge signature is not valid base64")
+	}
+	certificate, err := parseDeviceCertificate(deviceCert)
+	if err != nil {
+		return false, err
+	}
+	key, err := parseECCPublicKey(certificate.PublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	hash := sha1.Sum([]byte(challenge))
+	if !verifyECDSA(key, hash[:], signature) {
+		return false, errors.New("challenge signature is invalid")
+	}
+	return true, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// challengeRequest returns Register.certificate with the given challenge and signature, if any.
+func challengeRequest(t *testing.T, challenge string, signature []byte) []byte {
+	body, err := os.ReadFile(filepath.Join("testdata", "conformance", "ias", "Register.certificate.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elements := "<ias:Challenge>" + challenge + "</ias:Challenge>"
+	if signature != nil {
+		elements += "<ias:Signature>" + base64.StdEncoding.EncodeToString(signature) + "</ias:Signature>"
+	}
+	return []byte(strings.Replace(string(body), "</ias:Register>", elements+"</ias:Register>", 1))
+}
+
+func TestStrictChallenges(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	strictChallenges(&config)
+	verifyTestCertificates(&config)
+	currentConfig.Store(&config)
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	// The console certified within Register.certificate has its Hollywood ID as its private key.
+	const hollywoodId = 0x0402503b
+	sign := func(challenge string) []byte {
+		hash := sha1.Sum([]byte(challenge))
+		return signECDSA(big.NewInt(hollywoodId), hash[:], big.NewInt(42))
+	}
+	issue := func() string {
+		body, err := os.ReadFile(filepath.Join("testdata", "conformance", "ias", "GetChallenge.request.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = []byte(strings.ReplaceAll(string(body), "4362227770", "4362227771"))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, soapRequest("ias", "GetChallenge", body))
+		response := recorder.Body.String()
+		start := strings.Index(response, "<Challenge>") + len("<Challenge>")
+		end := strings.Index(response, "</Challenge>")
+		if recorder.Code != http.StatusOK || end < start {
+			t.Fatalf("GetChallenge failed: %s", response)
+		}
+		return response[start:end]
+	}
+	register := func(body []byte) string {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, soapRequest("ias", "Register", body))
+		return recorder.Body.String()
+	}
+
+	cases := []struct {
+		Name   string
+		Body   func(challenge string) []byte
+		Reason string
+	}{
+		{"signed", func(challenge string) []byte {
+			return challengeRequest(t, challenge, sign(challenge))
+		}, ""},
+		// Consoles presenting a certificate must prove they hold its key.
+		{"unsigned", func(challenge string) []byte {
+			return challengeRequest(t, challenge, nil)
+		}, "must be signed"},
+		{"wrong challenge", func(challenge string) []byte {
+			return challengeRequest(t, challenge+"x", sign(challenge+"x"))
+		}, "not issued"},
+		{"wrong signature", func(challenge string) []byte {
+			return challengeRequest(t, challenge, sign(challenge+"x"))
+		}, "signature is invalid"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			db = newTestDatabase()
+			challenge := issue()
+			if challenge == SharedChallenge || len(challenge) != ChallengeLength {
+				t.Fatalf("issued challenge %q", challenge)
+			}
+
+			response := register(c.Body(challenge))
+			if c.Reason == "" && !strings.Contains(response, "<ErrorCode>0</ErrorCode>") {
+				t.Fatalf("registration failed: %s", response)
+			} else if c.Reason != "" && !strings.Contains(response, c.Reason) {
+				t.Fatalf("expected %q within: %s", c.Reason, response)
+			}
+		})
+	}
+
+	t.Run("replayed", func(t *testing.T) {
+		db = newTestDatabase()
+		challenge := issue()
+		body := challengeRequest(t, challenge, sign(challenge))
+		register(body)
+		if response := register(body); !strings.Contains(response, "not issued") {
+			t.Fatalf("replayed challenge was accepted: %s", response)
+		}
+	})
+
+	// Others requesting a challenge for the console must not replace the one it is about to return.
+	t.Run("issued again", func(t *testing.T) {
+		db = newTestDatabase()
+		challenge := issue()
+		issue()
+		if response := register(challengeRequest(t, challenge, sign(challenge))); !strings.Contains(response, "<ErrorCode>0</ErrorCode>") {
+			t.Fatalf("earlier challenge was not accepted: %s", response)
+		}
+	})
+
+	// Only the newest are kept, however many others request.
+	t.Run("capped", func(t *testing.T) {
+		db = newTestDatabase()
+		var challenges []string
+		for i := 0; i <= MaxChallengesPerDevice; i++ {
+			now = func() time.Time {
+				return testTime.Add(time.Duration(i) * time.Second)
+			}
+			challenges = append(challenges, issue())
+		}
+		defer func() {
+			now = func() time.Time {
+				return testTime
+			}
+		}()
+
+		if count := len(db.(*memoryDatabase).challenges); count != MaxChallengesPerDevice {
+			t.Fatalf("%d challenges are outstanding", count)
+		}
+		if response := register(challengeRequest(t, challenges[0], sign(challenges[0]))); !strings.Contains(response, "not issued") {
+			t.Fatalf("oldest challenge was accepted: %s", response)
+		}
+		if response := register(challengeRequest(t, challenges[1], sign(challenges[1]))); !strings.Contains(response, "<ErrorCode>0</ErrorCode>") {
+			t.Fatalf("newer challenge was not accepted: %s", response)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		db = newTestDatabase()
+		challenge := issue()
+		now = func() time.Time {
+			return testTime.Add(config.Challenges.Lifetime.Duration)
+		}
+		defer func() {
+			now = func() time.Time {
+				return testTime
+			}
+		}()
+		if response := register(challengeRequest(t, challenge, nil)); !strings.Contains(response, "expired") {
+			t.Fatalf("expired challenge was accepted: %s", response)
+		}
+	})
+}
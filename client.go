@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client performs requests against WiiSOAP as the Wii Shop Channel would.
+type Client struct {
+	// BaseURL is where all services are reached, such as http://127.0.0.1:8080.
+	BaseURL string
+	HTTP    *http.Client
+
+	DeviceId     int
+	SerialNumber string
+	DeviceCode   string
+	Region       string
+	Country      string
+	Language     string
+
+	// DeviceCert is presented upon registering, if set.
+	DeviceCert []byte
+
+	// Populated upon registration or synchronization.
+	AccountId   int64
+	DeviceToken string
+
+	messages int
+}
+
+// clientRequest is implemented by all requests through embedding Request.
+type clientRequest interface {
+	common() *Request
+}
+
+// authenticatedRequest is implemented by requests embedding AuthenticatedRequest.
+type authenticatedRequest interface {
+	authentication() *AuthenticatedRequest
+}
+
+// SOAPError represents a response with a non-zero ErrorCode.
+type SOAPError struct {
+	ErrorCode    int
+	UserReason   string
+	ServerReason string
+}
+
+func (e *SOAPError) Error() string {
+	return fmt.Sprintf("error code %d: %s (%s)", e.ErrorCode, e.UserReason, e.ServerReason)
+}
+
+// HTTPError represents a response that was not a SOAP envelope, such as failed authentication.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Call sends a request for the given action, decoding its response.
+// Common fields, and authentication if the request requires it, are filled in.
+func (c *Client) Call(service string, action string, request clientRequest, response Responder) error {
+	c.messages++
+	common := request.common()
+	common.Version = "2.0"
+	common.MessageId = fmt.Sprintf("EC-%d-%d", c.DeviceId, c.messages)
+	common.DeviceId = c.DeviceId
+	common.Region = c.Region
+	common.Country = c.Country
+	common.Language = c.Language
+
+	// The console sends the MD5 of its token, rather than the token itself.
+	if authenticated, ok := request.(authenticatedRequest); ok {
+		authentication := authenticated.authentication()
+		authentication.AccountId = c.AccountId
+		authentication.DeviceToken = fmt.Sprintf("WT-%x", md5.Sum([]byte(c.DeviceToken)))
+	}
+
+	body, err := buildRequestEnvelope(service, action, request)
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequest("POST", strings.TrimSuffix(c.BaseURL, "/")+"/"+service+"/services/"+services[service]+"SOAP", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	httpRequest.Header.Set("SOAPAction", "urn:"+service+".wsapi.broadon.com/"+action)
+	httpRequest.Header.Set("User-Agent", "Opera/9.30 (Nintendo Wii; U; ; 3642; en)")
+
+	httpResponse, err := c.HTTP.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	contents, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+
+	return parseResponseEnvelope(httpResponse.StatusCode, contents, response)
+}
+
+// buildRequestEnvelope marshals a request within a SOAP envelope,
+// prefixing every element with the service's name as the console does.
+func buildRequestEnvelope(service string, action string, request interface{}) ([]byte, error) {
+	inner, err := xml.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	buffer.WriteString(`<soapenv:Envelope xmlns:soapenv="` + SOAPEnvelopeNamespace + `" xmlns:xsd="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">`)
+	buffer.WriteString(`<soapenv:Body>`)
+
+	decoder := xml.NewDecoder(bytes.NewReader(inner))
+	encoder := xml.NewEncoder(&buffer)
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			// The outermost element is named after the action, declaring the service's namespace.
+			element.Name.Local = service + ":" + element.Name.Local
+			if depth == 0 {
+				element.Name.Local = service + ":" + action
+				element.Attr = []xml.Attr{{Name: xml.Name{Local: "xmlns:" + service}, Value: "urn:" + service + ".wsapi.broadon.com"}}
+			}
+			depth++
+			token = element
+		case xml.EndElement:
+			depth--
+			element.Name.Local = service + ":" + element.Name.Local
+			if depth == 0 {
+				element.Name.Local = service + ":" + action
+			}
+			token = element
+		}
+
+		err = encoder.EncodeToken(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = encoder.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	buffer.WriteString(`</soapenv:Body></soapenv:Envelope>`)
+	return buffer.Bytes(), nil
+}
+
+// parseResponseEnvelope decodes the response within a SOAP envelope, returning an error for failed responses.
+func parseResponseEnvelope(statusCode int, contents []byte, response Responder) error {
+	var envelope struct {
+		Body struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	err := xml.Unmarshal(contents, &envelope)
+	if err != nil || len(bytes.TrimSpace(envelope.Body.Inner)) == 0 {
+		return &HTTPError{StatusCode: statusCode, Body: string(contents)}
+	}
+
+	var failure ErrorResponse
+	err = xml.Unmarshal(envelope.Body.Inner, &failure)
+	if err != nil {
+		return err
+	}
+	if failure.ErrorCode != 0 {
+		return &SOAPError{
+			ErrorCode:    failure.ErrorCode,
+			UserReason:   failure.UserReason,
+			ServerReason: failure.ServerReason,
+		}
+	}
+
+	return xml.Unmarshal(envelope.Body.Inner, response)
+}
+
+// ClientStep describes the outcome of an individual action within a flow.
+type ClientStep struct {
+	Service  string
+	Action   string
+	Duration time.Duration
+	Err      error
+	Detail   string
+}
+
+// ShopFlow performs the series of actions the Wii Shop Channel does upon launch and purchasing a title,
+// reporting each step. It stops at the first failure, returning its error.
+func (c *Client) ShopFlow(titleId string, report func(step ClientStep)) error {
+	call := func(service string, action string, request clientRequest, response Responder, detail func() string) error {
+		start := time.Now()
+		err := c.Call(service, action, request, response)
+		step := ClientStep{
+			Service:  service,
+			Action:   action,
+			Duration: time.Since(start),
+			Err:      err,
+		}
+		if err == nil && detail != nil {
+			step.Detail = detail()
+		}
+		report(step)
+		return err
+	}
+
+	config := &GetECConfigResponse{}
+	err := call("ecs", "GetECConfig", &GetECConfigRequest{}, config, func() string {
+		return "ECS at " + config.EcsURL
+	})
+	if err != nil {
+		return err
+	}
+
+	check := &CheckRegistrationResponse{}
+	err = call("ias", "CheckRegistration", &CheckRegistrationRequest{SerialNumber: c.SerialNumber}, check, func() string {
+		return "device status " + check.DeviceStatus
+	})
+	if err != nil {
+		return err
+	}
+
+	// Challenges are returned so that servers in strict mode accept us.
+	challenge := &GetChallengeResponse{}
+	err = call("ias", "GetChallenge", &GetChallengeRequest{}, challenge, func() string {
+		return "challenge " + challenge.Challenge
+	})
+	if err != nil {
+		return err
+	}
+
+	// Consoles already registered instead obtain a fresh token, authenticating with that they hold.
+	// Without one, they must sign their challenge to be issued another, which we cannot do.
+	if c.DeviceToken != "" {
+		info := &GetRegistrationInfoResponse{}
+		err = call("ias", "GetRegistrationInfo", &GetRegistrationInfoRequest{}, info, func() string {
+			return fmt.Sprintf("account %d", info.AccountId)
+		})
+		if err != nil {
+			return err
+		}
+		c.AccountId = info.AccountId
+		c.DeviceToken = info.DeviceToken
+	} else if check.DeviceStatus != DeviceStatusRegistered {
+		registration := &RegisterResponse{}
+		err = call("ias", "Register", &RegisterRequest{
+			DeviceCode:     c.DeviceCode,
+			RegisterRegion: c.Region,
+			SerialNumber:   c.SerialNumber,
+			DeviceCert:     base64.StdEncoding.EncodeToString(c.DeviceCert),
+			Challenge:      challenge.Challenge,
+		}, registration, func() string {
+			return fmt.Sprintf("account %d", registration.AccountId)
+		})
+		if err != nil {
+			return err
+		}
+		c.AccountId = registration.AccountId
+		c.DeviceToken = registration.DeviceToken
+	} else {
+		sync := &SyncRegistrationResponse{}
+		err = call("ias", "SyncRegistration", &SyncRegistrationRequest{Challenge: challenge.Challenge}, sync, func() string {
+			return fmt.Sprintf("account %d", sync.AccountId)
+		})
+		if err != nil {
+			return err
+		}
+		if sync.DeviceToken == "" {
+			return errors.New("the console is registered, but no device token was issued as its challenge was not signed")
+		}
+		c.AccountId = sync.AccountId
+		c.DeviceToken = sync.DeviceToken
+	}
+
+	status := &CheckDeviceStatusResponse{}
+	err = call("ecs", "CheckDeviceStatus", &CheckDeviceStatusRequest{}, status, func() string {
+		return fmt.Sprintf("balance %d %s", status.Balance.Amount, status.Balance.Currency)
+	})
+	if err != nil {
+		return err
+	}
+
+	tickets := &ListETicketsResponse{}
+	err = call("ecs", "ListETickets", &ListETicketsRequest{}, tickets, func() string {
+		return fmt.Sprintf("%d tickets", len(tickets.Tickets))
+	})
+	if err != nil {
+		return err
+	}
+
+	purchase := &PurchaseTitleResponse{}
+	err = call("ecs", "PurchaseTitle", &PurchaseTitleRequest{
+		ItemId:  1,
+		TitleId: titleId,
+		Price: Price{
+			Amount:   0,
+			Currency: "POINTS",
+		},
+	}, purchase, func() string {
+		return "transaction " + purchase.Transactions.TransactionId
+	})
+	if err != nil {
+		return err
+	}
+
+	return call("ecs", "GetETickets", &GetETicketsRequest{}, &GetETicketsResponse{}, nil)
+}
+
+// clientCommand performs the Wii Shop Channel's flow against a server, reporting each step.
+func clientCommand(args []string) int {
+	flags := flag.NewFlagSet("client", flag.ExitOnError)
+	baseURL := flags.String("url", "http://127.0.0.1:8080", "base URL of the server")
+	deviceId := flags.Int("device-id", 4362227770, "device ID to identify as")
+	serialNumber := flags.String("serial", "LU521023236", "serial number to register with")
+	deviceCode := flags.String("device-code", "1234567890123516", "device code (Wii Number) to register with")
+	region := flags.String("region", "USA", "region of the console")
+	country := flags.String("country", "US", "country of the console")
+	language := flags.String("language", "en", "language of the console")
+	deviceCertPath := flags.String("device-cert", "", "file holding the device certificate to register with, if any")
+	accountId := flags.Int64("account-id", 0, "account ID of the console, if already registered")
+	deviceToken := flags.String("device-token", "", "device token issued to the console, if already registered")
+	titleId := flags.String("title", "0001000148414241", "title ID to purchase")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for each request")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: WiiSOAP client [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	client := &Client{
+		BaseURL:      *baseURL,
+		HTTP:         &http.Client{Timeout: *timeout},
+		DeviceId:     *deviceId,
+		SerialNumber: *serialNumber,
+		DeviceCode:   *deviceCode,
+		Region:       *region,
+		Country:      *country,
+		Language:     *language,
+		AccountId:    *accountId,
+		DeviceToken:  *deviceToken,
+	}
+	if *deviceCertPath != "" {
+		deviceCert, err := os.ReadFile(*deviceCertPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		client.DeviceCert = deviceCert
+	}
+
+	err := client.ShopFlow(*titleId, func(step ClientStep) {
+		if step.Err != nil {
+			fmt.Printf("[FAIL] %s %s (%v): %v\n", strings.ToUpper(step.Service), step.Action, step.Duration.Round(time.Millisecond), step.Err)
+		} else {
+			fmt.Printf("[ OK ] %s %s (%v) %s\n", strings.ToUpper(step.Service), step.Action, step.Duration.Round(time.Millisecond), step.Detail)
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "The shop flow did not complete:", err)
+		return 1
+	}
+
+	fmt.Println("The shop flow completed successfully.")
+	return 0
+}
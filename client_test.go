@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientShopFlow(t *testing.T) {
+	setupTestServer(t)
+	route := newServiceRoute()
+	server := httptest.NewServer(route.Handle())
+	defer server.Close()
+
+	tokenless := func() *Client {
+		return &Client{
+			BaseURL:      server.URL,
+			HTTP:         server.Client(),
+			DeviceId:     testDeviceId,
+			SerialNumber: "LU521023236",
+			DeviceCode:   "1234567890123516",
+			Region:       "USA",
+			Country:      "US",
+			Language:     "en",
+		}
+	}
+	registered := func() *Client {
+		client := tokenless()
+		client.AccountId = testAccountId
+		client.DeviceToken = testDeviceToken
+		return client
+	}
+	unregistered := func() *Client {
+		client := tokenless()
+		client.DeviceId = 4362227771
+		client.SerialNumber = "LU521023243"
+		client.DeviceCode = "1234567890124196"
+		return client
+	}
+
+	cases := []struct {
+		Name    string
+		Client  *Client
+		Bans    []memoryBan
+		Actions []string
+		// Failed is set if the flow should not complete, with ErrorCode set if due to a SOAP error.
+		Failed    bool
+		ErrorCode int
+	}{
+		{"registering", unregistered(), nil, []string{
+			"GetECConfig", "CheckRegistration", "GetChallenge", "Register",
+			"CheckDeviceStatus", "ListETickets", "PurchaseTitle", "GetETickets",
+		}, false, 0},
+		{"registered", registered(), nil, []string{
+			"GetECConfig", "CheckRegistration", "GetChallenge", "GetRegistrationInfo",
+			"CheckDeviceStatus", "ListETickets", "PurchaseTitle", "GetETickets",
+		}, false, 0},
+		// Without signing its challenge, a console lacking its token is not issued another.
+		{"registered without a token", tokenless(), nil, []string{
+			"GetECConfig", "CheckRegistration", "GetChallenge", "SyncRegistration",
+		}, true, 0},
+		{"failing to register", unregistered(), []memoryBan{
+			{Kind: BanDeviceCode, Value: "1234567890124196", Created: testTime},
+		}, []string{
+			"GetECConfig", "CheckRegistration", "GetChallenge", "Register",
+		}, true, bannedErrorCode("ias")},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			database := newTestDatabase()
+			database.bans = c.Bans
+			db = database
+			verifiedTokens = newAuthCache()
+
+			var actions []string
+			var failed *ClientStep
+			err := c.Client.ShopFlow("0001000148414241", func(step ClientStep) {
+				actions = append(actions, step.Action)
+				if step.Err != nil {
+					failed = &step
+				}
+			})
+			if !reflect.DeepEqual(actions, c.Actions) {
+				t.Errorf("performed %v, expected %v", actions, c.Actions)
+			}
+
+			if !c.Failed {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.Client.AccountId == 0 || c.Client.DeviceToken == "" {
+					t.Errorf("credentials were not obtained: account %d, token %q", c.Client.AccountId, c.Client.DeviceToken)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("the flow completed")
+			}
+			if c.ErrorCode == 0 {
+				return
+			}
+
+			// The error returned must be that of the action which failed.
+			var soapError *SOAPError
+			if !errors.As(err, &soapError) || soapError.ErrorCode != c.ErrorCode {
+				t.Fatalf("returned %v, expected error code %d", err, c.ErrorCode)
+			}
+			if failed == nil || failed.Err != err {
+				t.Errorf("returned %v, but %v was reported", err, failed)
+			}
+		})
+	}
+}
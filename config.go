@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// EnvironmentPrefix precedes the upper-cased name of a Config field within environment variables,
+// such as WIISOAP_SQLPASS for SQLPass.
+const EnvironmentPrefix = "WIISOAP_"
+
+// currentConfig holds the settings in effect, swapped atomically upon reload.
+var currentConfig atomic.Pointer[Config]
+
+// reloadableSettings are the Config fields which take effect without restarting.
+var reloadableSettings = map[string]bool{
+	"BaseURL":             true,
+	"URLs":                true,
+	"RegionURLs":          true,
+	"Debug":               true,
+	"LogLevel":            true,
+	"DeviceTokenLifetime": true,
+	"AuthCacheTTL":        true,
+	"RateLimits":          true,
+	"Challenges":          true,
+	"DeviceCertificates":  true,
+	"AdminToken":          true,
+}
+
+// settings returns the configuration currently in effect. It must not be modified.
+func settings() *Config {
+	return currentConfig.Load()
+}
+
+// ConfigErrors describes every problem found within a configuration.
+type ConfigErrors []error
+
+func (c ConfigErrors) Error() string {
+	messages := make([]string, len(c))
+	for i, err := range c {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// loadConfig reads the configuration at path, applies environment overrides, and validates the result.
+// A missing file is permitted if required is false, so that configuration may come solely from the environment.
+func loadConfig(path string, required bool) (Config, error) {
+	config := defaultConfig()
+
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !required {
+		logger.Warn("no config file found, using defaults and environment", "path", path)
+	} else if err != nil {
+		return config, err
+	} else {
+		err = xml.Unmarshal(contents, &config)
+		if err != nil {
+			return config, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	problems := applyEnvironment(&config, os.LookupEnv)
+	problems = append(problems, config.validate()...)
+	if len(problems) != 0 {
+		return config, problems
+	}
+
+	return config, nil
+}
+
+// environmentName returns the variable overriding the given Config field, such as Challenges.Lifetime.
+func environmentName(field string) string {
+	return EnvironmentPrefix + strings.ToUpper(strings.ReplaceAll(field, ".", "_"))
+}
+
+// applyEnvironment overrides fields within config with those present in the environment.
+// Fields of nested structures are named after their parent, such as WIISOAP_URLS_ECSURL.
+// Repeated elements, such as RegionURLs and RateLimits' Action, can only be given within the file;
+// setting their variables is reported as a problem rather than ignored.
+func applyEnvironment(config *Config, lookup func(string) (string, bool)) ConfigErrors {
+	return applyEnvironmentFields(reflect.ValueOf(config).Elem(), EnvironmentPrefix, lookup)
+}
+
+func applyEnvironmentFields(value reflect.Value, prefix string, lookup func(string) (string, bool)) ConfigErrors {
+	var problems ConfigErrors
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Name == "XMLName" {
+			continue
+		}
+
+		name := prefix + strings.ToUpper(field.Name)
+		if _, ok := value.Field(i).Addr().Interface().(encoding.TextUnmarshaler); !ok && field.Type.Kind() == reflect.Struct {
+			problems = append(problems, applyEnvironmentFields(value.Field(i), name+"_", lookup)...)
+			continue
+		}
+
+		contents, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		err := setField(value.Field(i), contents)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return problems
+}
+
+// setField parses contents into the given field according to its type.
+func setField(field reflect.Value, contents string) error {
+	if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(contents))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(contents)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(contents)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", contents)
+		}
+		field.SetBool(parsed)
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(contents, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", contents)
+		}
+		field.SetFloat(parsed)
+	case reflect.Int, reflect.Int64:
+		parsed, err := strconv.ParseInt(contents, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", contents)
+		}
+		field.SetInt(parsed)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// validate returns every problem with the configuration, naming the element and variable to correct.
+func (c *Config) validate() ConfigErrors {
+	var problems ConfigErrors
+	problem := func(field string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf("%s (%s) %s", field, environmentName(field), fmt.Sprintf(format, args...)))
+	}
+
+	if c.Address == "" {
+		problem("Address", "is required, such as 127.0.0.1:8080")
+	}
+	if c.BaseURL == "" {
+		problem("BaseURL", "is required, such as example.com")
+	}
+	problems = append(problems, c.URLs.validate("URLs")...)
+	for i, override := range c.RegionURLs {
+		field := fmt.Sprintf("RegionURLs[%d]", i)
+		if override.Region == "" && override.Country == "" {
+			problems = append(problems, fmt.Errorf("%s must specify a Region or Country attribute", field))
+		}
+		problems = append(problems, override.ServiceURLs.validate(field)...)
+	}
+
+	if c.TLSAddress != "" {
+		if c.TLSCert == "" {
+			problem("TLSCert", "is required when TLSAddress is set")
+		}
+		if c.TLSKey == "" {
+			problem("TLSKey", "is required when TLSAddress is set")
+		}
+	}
+
+	if c.SQLAddress == "" {
+		problem("SQLAddress", "is required, such as 127.0.0.1:5432")
+	}
+	if c.SQLUser == "" {
+		problem("SQLUser", "is required")
+	}
+	if c.SQLDB == "" {
+		problem("SQLDB", "is required")
+	}
+
+	switch strings.ToLower(c.LogFormat) {
+	case "", "text", "json":
+	default:
+		problem("LogFormat", "must be text or json, not %q", c.LogFormat)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problem("LogLevel", "must be debug, info, warn or error, not %q", c.LogLevel)
+	}
+
+	timeouts := []struct {
+		Name    string
+		Timeout Duration
+	}{
+		{"ReadTimeout", c.ReadTimeout},
+		{"WriteTimeout", c.WriteTimeout},
+		{"IdleTimeout", c.IdleTimeout},
+		{"ShutdownTimeout", c.ShutdownTimeout},
+		{"ReloadInterval", c.ReloadInterval},
+	}
+	for _, timeout := range timeouts {
+		if timeout.Timeout.Duration < 0 {
+			problem(timeout.Name, "must not be negative")
+		}
+	}
+
+	if c.DeviceTokenLifetime.Duration < 0 {
+		problem("DeviceTokenLifetime", "must not be negative")
+	}
+	if c.AuthCacheTTL.Duration < 0 {
+		problem("AuthCacheTTL", "must not be negative")
+	}
+	problems = append(problems, c.RateLimits.validate()...)
+	if c.RateLimits.enabled() && !c.RateLimits.TrustProxy && c.TLSAddress == "" {
+		// Consoles must otherwise connect via a proxy, whose address they would all share.
+		problems = append(problems, errors.New("RateLimits require TrustProxy when behind a proxy, or TLSAddress to serve consoles directly"))
+	}
+	if c.Challenges.Strict && c.Challenges.Lifetime.Duration <= 0 {
+		problem("Challenges.Lifetime", "must be positive when strict, such as 5m")
+	}
+	problems = append(problems, c.DeviceCertificates.validate()...)
+	if c.AdminAddress != "" && (c.AdminAddress == c.Address || c.AdminAddress == c.TLSAddress) {
+		problem("AdminAddress", "must differ from Address and TLSAddress, as consoles must not reach it")
+	}
+	if c.AdminToken != "" && c.AdminAddress == "" {
+		problem("AdminToken", "requires AdminAddress, upon which the administrative API is served")
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < MinimumAdminTokenLength {
+		problem("AdminToken", "must be at least %d characters, or empty to disable administration", MinimumAdminTokenLength)
+	}
+
+	if c.MaxRequestSize <= 0 {
+		problem("MaxRequestSize", "must be a positive number of bytes")
+	}
+	if c.CaptureDir != "" {
+		if c.CaptureMaxSize <= 0 {
+			problem("CaptureMaxSize", "must be a positive number of bytes")
+		}
+		if c.CaptureMaxFiles <= 0 {
+			problem("CaptureMaxFiles", "must be positive")
+		}
+		for _, element := range c.captureRedactElements() {
+			if !elementName.MatchString(element) {
+				problem("CaptureRedactElements", "must be a comma-separated list of element names, not containing %q", element)
+			}
+		}
+	}
+
+	return problems
+}
+
+// elementName matches the local names of elements which may be redacted.
+var elementName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// captureRedactElements returns the names of elements redacted from captures.
+func (c *Config) captureRedactElements() []string {
+	var elements []string
+	for _, element := range strings.Split(c.CaptureRedactElements, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+
+	return elements
+}
+
+// validate ensures the MS public key parses and an issuer is named.
+func (d *DeviceCertificates) validate() ConfigErrors {
+	var problems ConfigErrors
+
+	if _, _, err := d.publicKey(); err != nil {
+		problems = append(problems, fmt.Errorf("DeviceCertificates.MSPublicKey must be the 60 byte hexadecimal key of the MS: %v", err))
+	}
+	if d.Issuer == "" {
+		problems = append(problems, fmt.Errorf("DeviceCertificates.Issuer is required, such as %s", DefaultDeviceCertificateIssuer))
+	}
+
+	return problems
+}
+
+// enabled returns whether any requests are limited, or clients banned.
+func (r *RateLimits) enabled() bool {
+	for _, override := range r.Actions {
+		if override.Rate > 0 {
+			return true
+		}
+	}
+
+	return r.Rate > 0 || r.AuthFailures > 0
+}
+
+// validate ensures rates, bursts and durations are sensible.
+func (r *RateLimits) validate() ConfigErrors {
+	var problems ConfigErrors
+
+	if r.Rate < 0 {
+		problems = append(problems, errors.New("RateLimits.Rate must not be negative"))
+	} else if r.Rate > 0 && r.Burst < 1 {
+		problems = append(problems, errors.New("RateLimits.Burst must be at least 1 when limiting"))
+	}
+	for i, override := range r.Actions {
+		if override.Action == "" {
+			problems = append(problems, fmt.Errorf("RateLimits.Action[%d] must specify a Name attribute", i))
+		}
+		if override.Rate < 0 {
+			problems = append(problems, fmt.Errorf("RateLimits.Action[%d] Rate must not be negative", i))
+		} else if override.Rate > 0 && override.Burst < 1 {
+			problems = append(problems, fmt.Errorf("RateLimits.Action[%d] Burst must be at least 1 when limiting", i))
+		}
+	}
+
+	if r.AuthFailures < 0 {
+		problems = append(problems, errors.New("RateLimits.AuthFailures must not be negative"))
+	}
+	if r.AuthFailures > 0 && (r.AuthFailureWindow.Duration <= 0 || r.BanDuration.Duration <= 0) {
+		problems = append(problems, errors.New("RateLimits.AuthFailureWindow and BanDuration must be positive when banning"))
+	}
+
+	return problems
+}
+
+// validate ensures every URL specified is absolute, using HTTP or HTTPS.
+func (u ServiceURLs) validate(parent string) ConfigErrors {
+	var problems ConfigErrors
+
+	value := reflect.ValueOf(u)
+	for i := 0; i < value.NumField(); i++ {
+		contents := value.Field(i).String()
+		if contents == "" {
+			continue
+		}
+
+		parsed, err := url.Parse(contents)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("%s.%s must be an http:// or https:// URL, not %q", parent, value.Type().Field(i).Name, contents))
+		}
+	}
+
+	return problems
+}
+
+// override replaces URLs with those specified within other.
+func (u *ServiceURLs) override(other ServiceURLs) {
+	value := reflect.ValueOf(u).Elem()
+	otherValue := reflect.ValueOf(other)
+	for i := 0; i < value.NumField(); i++ {
+		if contents := otherValue.Field(i).String(); contents != "" {
+			value.Field(i).SetString(contents)
+		}
+	}
+}
+
+// ForService returns the URL for the given service, such as "ecs".
+func (u ServiceURLs) ForService(service string) string {
+	switch service {
+	case "ecs":
+		return u.EcsURL
+	case "ias":
+		return u.IasURL
+	case "cas":
+		return u.CasURL
+	case "nus":
+		return u.NusURL
+	}
+
+	return ""
+}
+
+// ServiceURLs returns the URLs for a console within the given region and country.
+// Overrides specifying both a region and country take precedence over those specifying a country,
+// which take precedence over those specifying a region.
+func (c *Config) ServiceURLs(region string, country string) ServiceURLs {
+	urls := ServiceURLs{
+		EcsURL:           genServiceUrl(c.BaseURL, "ecs", "ECommerceSOAP"),
+		IasURL:           genServiceUrl(c.BaseURL, "ias", "IdentityAuthenticationSOAP"),
+		CasURL:           genServiceUrl(c.BaseURL, "cas", "CatalogingSOAP"),
+		NusURL:           genServiceUrl(c.BaseURL, "nus", "NetUpdateSOAP"),
+		ContentPrefixURL: fmt.Sprintf("http://ccs.%s/ccs/download", c.BaseURL),
+	}
+	urls.override(c.URLs)
+
+	for _, specificity := range [][2]bool{{true, false}, {false, true}, {true, true}} {
+		for _, override := range c.RegionURLs {
+			if (override.Region != "") != specificity[0] || (override.Country != "") != specificity[1] {
+				continue
+			}
+			if (override.Region == "" || override.Region == region) && (override.Country == "" || override.Country == country) {
+				urls.override(override.ServiceURLs)
+			}
+		}
+	}
+
+	if urls.UncachedContentPrefixURL == "" {
+		urls.UncachedContentPrefixURL = urls.ContentPrefixURL
+	}
+	if urls.SystemContentPrefixURL == "" {
+		urls.SystemContentPrefixURL = urls.ContentPrefixURL
+	}
+	if urls.SystemUncachedContentPrefixURL == "" {
+		urls.SystemUncachedContentPrefixURL = urls.UncachedContentPrefixURL
+	}
+
+	return urls
+}
+
+// logConfigError logs every problem within a configuration individually.
+func logConfigError(err error) {
+	var problems ConfigErrors
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			logger.Error("invalid configuration", "problem", problem)
+		}
+	} else {
+		logger.Error("failed to read configuration", "err", err)
+	}
+}
+
+// warn logs settings which are valid, but unlikely to do what is intended.
+func (c *Config) warn() {
+	if c.Challenges.Strict && c.DeviceCertificates.MSPublicKey == "" {
+		logger.Warn("strict challenges cannot prove a console's identity without DeviceCertificates.MSPublicKey, as no device certificate is verified")
+	}
+}
+
+// reloadConfig loads the configuration again, putting any reloadable settings into effect.
+// Other settings retain their current values, as they are only used upon startup.
+func reloadConfig(path string, required bool) error {
+	next, err := loadConfig(path, required)
+	if err != nil {
+		return err
+	}
+
+	current := settings()
+	nextValue := reflect.ValueOf(&next).Elem()
+	currentValue := reflect.ValueOf(current).Elem()
+
+	var changed, restartRequired []string
+	for i := 0; i < nextValue.NumField(); i++ {
+		name := nextValue.Type().Field(i).Name
+		if name == "XMLName" || reflect.DeepEqual(nextValue.Field(i).Interface(), currentValue.Field(i).Interface()) {
+			continue
+		}
+
+		if reloadableSettings[name] {
+			changed = append(changed, name)
+		} else {
+			restartRequired = append(restartRequired, name)
+			nextValue.Field(i).Set(currentValue.Field(i))
+		}
+	}
+
+	if len(restartRequired) != 0 {
+		logger.Warn("some changed settings require a restart to take effect", "settings", restartRequired)
+	}
+	if len(changed) == 0 {
+		logger.Info("configuration reloaded, no settings changed")
+		return nil
+	}
+
+	err = setLogLevel(next.LogLevel, next.Debug)
+	if err != nil {
+		return err
+	}
+	currentConfig.Store(&next)
+	logger.Info("configuration reloaded", "changed", changed)
+	next.warn()
+
+	return nil
+}
+
+// modificationTime returns when the file at path was last modified, or the zero time if unavailable.
+func modificationTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// watchConfig reloads the configuration upon SIGHUP, or upon the file at path changing
+// if interval is positive, until ctx is done.
+func watchConfig(ctx context.Context, path string, required bool, interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	lastModified := modificationTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			logger.Info("received SIGHUP, reloading configuration", "path", path)
+		case <-ticks:
+			if modificationTime(path).Equal(lastModified) {
+				continue
+			}
+			logger.Info("configuration file changed, reloading", "path", path)
+		}
+
+		lastModified = modificationTime(path)
+		err := reloadConfig(path, required)
+		if err != nil {
+			logConfigError(err)
+			logger.Warn("continuing with the previous configuration")
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validTestConfig returns a configuration with every required setting.
+func validTestConfig() Config {
+	config := defaultConfig()
+	config.Address = "127.0.0.1:8080"
+	config.BaseURL = "example.com"
+	config.SQLAddress = "127.0.0.1:5432"
+	config.SQLUser = "wiisoap"
+	config.SQLDB = "wiisoap"
+	return config
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	cases := []struct {
+		Name        string
+		Environment map[string]string
+		Expected    func(config *Config)
+		Problems    []string
+	}{
+		{"none", nil, func(config *Config) {}, nil},
+		{"string", map[string]string{"WIISOAP_SQLPASS": "secret"}, func(config *Config) {
+			config.SQLPass = "secret"
+		}, nil},
+		{"bool", map[string]string{"WIISOAP_DEBUG": "true"}, func(config *Config) {
+			config.Debug = true
+		}, nil},
+		{"integer", map[string]string{"WIISOAP_MAXREQUESTSIZE": "4096"}, func(config *Config) {
+			config.MaxRequestSize = 4096
+		}, nil},
+		{"duration", map[string]string{"WIISOAP_READTIMEOUT": "1m30s"}, func(config *Config) {
+			config.ReadTimeout = Duration{90 * time.Second}
+		}, nil},
+		{"nested", map[string]string{"WIISOAP_URLS_ECSURL": "https://ecs.example.org/ecs", "WIISOAP_RATELIMITS_RATE": "2.5"}, func(config *Config) {
+			config.URLs.EcsURL = "https://ecs.example.org/ecs"
+			config.RateLimits.Rate = 2.5
+		}, nil},
+		{"empty", map[string]string{"WIISOAP_BASEURL": ""}, func(config *Config) {
+			config.BaseURL = ""
+		}, nil},
+		{"invalid", map[string]string{"WIISOAP_DEBUG": "maybe", "WIISOAP_CAPTUREMAXFILES": "many", "WIISOAP_IDLETIMEOUT": "soon"}, func(config *Config) {}, []string{
+			"WIISOAP_DEBUG", "WIISOAP_IDLETIMEOUT", "WIISOAP_CAPTUREMAXFILES",
+		}},
+		// Repeated elements can only be given within the file.
+		{"repeated", map[string]string{"WIISOAP_REGIONURLS": "EUR", "WIISOAP_RATELIMITS_ACTIONS": "Register"}, func(config *Config) {}, []string{
+			"WIISOAP_REGIONURLS", "WIISOAP_RATELIMITS_ACTIONS",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			config := validTestConfig()
+			expected := validTestConfig()
+			c.Expected(&expected)
+
+			problems := applyEnvironment(&config, func(name string) (string, bool) {
+				contents, ok := c.Environment[name]
+				return contents, ok
+			})
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("configured %+v, expected %+v", config, expected)
+			}
+			if len(problems) != len(c.Problems) {
+				t.Fatalf("reported %v, expected problems with %v", problems, c.Problems)
+			}
+			for i, problem := range problems {
+				if !strings.HasPrefix(problem.Error(), c.Problems[i]+":") {
+					t.Errorf("reported %q, expected a problem with %s", problem, c.Problems[i])
+				}
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Configure func(config *Config)
+		Problems  []string
+	}{
+		{"valid", func(config *Config) {}, nil},
+		{"required", func(config *Config) {
+			config.Address = ""
+			config.SQLUser = ""
+		}, []string{"Address (WIISOAP_ADDRESS)", "SQLUser (WIISOAP_SQLUSER)"}},
+		// Every problem is reported at once, rather than only the first.
+		{"several", func(config *Config) {
+			config.TLSAddress = ":443"
+			config.LogFormat = "xml"
+			config.ReadTimeout = Duration{-time.Second}
+			config.URLs.IasURL = "ias.example.com"
+			config.RegionURLs = []RegionURLs{{}}
+			config.RateLimits.Rate = 5
+			config.RateLimits.Burst = 0
+			config.RateLimits.TrustProxy = true
+			config.AdminToken = "short"
+			config.MaxRequestSize = 0
+		}, []string{
+			"URLs.IasURL",
+			"RegionURLs[0] must specify",
+			"TLSCert (WIISOAP_TLSCERT)",
+			"TLSKey (WIISOAP_TLSKEY)",
+			"LogFormat (WIISOAP_LOGFORMAT)",
+			"ReadTimeout (WIISOAP_READTIMEOUT)",
+			"RateLimits.Burst",
+			"AdminToken (WIISOAP_ADMINTOKEN)",
+			"MaxRequestSize (WIISOAP_MAXREQUESTSIZE)",
+		}},
+		// Nested fields are named as their environment variables are.
+		{"strict challenges", func(config *Config) {
+			config.Challenges.Strict = true
+			config.Challenges.Lifetime = Duration{}
+		}, []string{"Challenges.Lifetime (WIISOAP_CHALLENGES_LIFETIME)"}},
+		// Clients behind a proxy would otherwise share its address, so all be limited and banned together.
+		{"untrusted limits", func(config *Config) {
+			config.RateLimits.AuthFailures = 10
+		}, []string{"RateLimits require TrustProxy"}},
+		{"trusted limits", func(config *Config) {
+			config.RateLimits.Rate = 5
+			config.RateLimits.AuthFailures = 10
+			config.RateLimits.TrustProxy = true
+		}, nil},
+		{"direct limits", func(config *Config) {
+			config.RateLimits.Actions = []ActionRateLimit{{Service: "ias", Action: "Register", Rate: 0.1, Burst: 5}}
+			config.TLSAddress = ":443"
+			config.TLSCert = "cert.pem"
+			config.TLSKey = "key.pem"
+		}, nil},
+		{"public administration", func(config *Config) {
+			config.AdminAddress = config.Address
+		}, []string{"AdminAddress (WIISOAP_ADMINADDRESS)"}},
+		{"administration without address", func(config *Config) {
+			config.AdminAddress = ""
+			config.AdminToken = testAdminToken
+		}, []string{"AdminToken (WIISOAP_ADMINTOKEN)"}},
+		{"capture", func(config *Config) {
+			config.CaptureDir = "captures"
+			config.CaptureMaxFiles = 0
+			config.CaptureRedactElements = "DeviceToken, <Signature>"
+		}, []string{
+			"CaptureMaxFiles (WIISOAP_CAPTUREMAXFILES)",
+			"CaptureRedactElements (WIISOAP_CAPTUREREDACTELEMENTS)",
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			config := validTestConfig()
+			c.Configure(&config)
+
+			problems := config.validate()
+			if len(problems) != len(c.Problems) {
+				t.Fatalf("reported %v, expected problems with %v", problems, c.Problems)
+			}
+			for i, problem := range problems {
+				if !strings.HasPrefix(problem.Error(), c.Problems[i]) {
+					t.Errorf("reported %q, expected a problem with %s", problem, c.Problems[i])
+				}
+			}
+		})
+	}
+}
+
+// writeTestConfig writes a valid configuration file to path, with the given elements in addition.
+func writeTestConfig(t *testing.T, path string, elements string) {
+	contents := `<Config>
+    <SQLAddress>127.0.0.1:5432</SQLAddress>
+    <SQLUser>wiisoap</SQLUser>
+    <SQLDB>wiisoap</SQLDB>
+    ` + elements + `
+</Config>`
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	previousLogger := logger
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "config.xml")
+	previous := settings()
+	t.Cleanup(func() {
+		currentConfig.Store(previous)
+		logger = previousLogger
+	})
+
+	cases := []struct {
+		Name     string
+		Elements string
+		Expected func(config *Config)
+		Err      bool
+	}{
+		{"unchanged", `<Address>127.0.0.1:8080</Address><BaseURL>example.com</BaseURL>`, func(config *Config) {}, false},
+		{"reloadable", `<Address>127.0.0.1:8080</Address><BaseURL>example.org</BaseURL><AuthCacheTTL>1m</AuthCacheTTL>`, func(config *Config) {
+			config.BaseURL = "example.org"
+			config.AuthCacheTTL = Duration{time.Minute}
+		}, false},
+		// Settings only used upon startup retain their values until restarting.
+		{"restart required", `<Address>0.0.0.0:80</Address><BaseURL>example.org</BaseURL><SQLDB>other</SQLDB><MaxRequestSize>1</MaxRequestSize>`, func(config *Config) {
+			config.BaseURL = "example.org"
+		}, false},
+		{"invalid", `<Address>127.0.0.1:8080</Address><BaseURL>example.org</BaseURL><LogFormat>xml</LogFormat>`, func(config *Config) {}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			writeTestConfig(t, path, `<Address>127.0.0.1:8080</Address><BaseURL>example.com</BaseURL>`)
+			initial, err := loadConfig(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			currentConfig.Store(&initial)
+			expected := initial
+			c.Expected(&expected)
+
+			writeTestConfig(t, path, c.Elements)
+			err = reloadConfig(path, true)
+			if (err != nil) != c.Err {
+				t.Errorf("reload returned %v", err)
+			}
+			if !reflect.DeepEqual(*settings(), expected) {
+				t.Errorf("reloaded %+v, expected %+v", *settings(), expected)
+			}
+		})
+	}
+}
+
+func TestServiceURLs(t *testing.T) {
+	config := validTestConfig()
+	config.URLs.NusURL = "https://nus.example.org/nus/services/NetUpdateSOAP"
+	config.RegionURLs = []RegionURLs{
+		// Listed from most to least specific, as precedence must not depend upon order.
+		{Region: "EUR", Country: "GB", ServiceURLs: ServiceURLs{ContentPrefixURL: "https://gb.example.com/ccs/download"}},
+		{Country: "GB", ServiceURLs: ServiceURLs{ContentPrefixURL: "https://uk.example.com/ccs/download", EcsURL: "https://uk.example.com/ecs"}},
+		{Region: "EUR", ServiceURLs: ServiceURLs{ContentPrefixURL: "https://eu.example.com/ccs/download", IasURL: "https://eu.example.com/ias", UncachedContentPrefixURL: "https://eu.example.com/uncached"}},
+	}
+
+	cases := []struct {
+		Name     string
+		Region   string
+		Country  string
+		Expected ServiceURLs
+	}{
+		{"default", "USA", "US", ServiceURLs{
+			EcsURL:                         "http://ecs.example.com/ecs/services/ECommerceSOAP",
+			IasURL:                         "http://ias.example.com/ias/services/IdentityAuthenticationSOAP",
+			CasURL:                         "http://cas.example.com/cas/services/CatalogingSOAP",
+			NusURL:                         "https://nus.example.org/nus/services/NetUpdateSOAP",
+			ContentPrefixURL:               "http://ccs.example.com/ccs/download",
+			UncachedContentPrefixURL:       "http://ccs.example.com/ccs/download",
+			SystemContentPrefixURL:         "http://ccs.example.com/ccs/download",
+			SystemUncachedContentPrefixURL: "http://ccs.example.com/ccs/download",
+		}},
+		{"region", "EUR", "FR", ServiceURLs{
+			EcsURL:                         "http://ecs.example.com/ecs/services/ECommerceSOAP",
+			IasURL:                         "https://eu.example.com/ias",
+			CasURL:                         "http://cas.example.com/cas/services/CatalogingSOAP",
+			NusURL:                         "https://nus.example.org/nus/services/NetUpdateSOAP",
+			ContentPrefixURL:               "https://eu.example.com/ccs/download",
+			UncachedContentPrefixURL:       "https://eu.example.com/uncached",
+			SystemContentPrefixURL:         "https://eu.example.com/ccs/download",
+			SystemUncachedContentPrefixURL: "https://eu.example.com/uncached",
+		}},
+		{"country", "USA", "GB", ServiceURLs{
+			EcsURL:                         "https://uk.example.com/ecs",
+			IasURL:                         "http://ias.example.com/ias/services/IdentityAuthenticationSOAP",
+			CasURL:                         "http://cas.example.com/cas/services/CatalogingSOAP",
+			NusURL:                         "https://nus.example.org/nus/services/NetUpdateSOAP",
+			ContentPrefixURL:               "https://uk.example.com/ccs/download",
+			UncachedContentPrefixURL:       "https://uk.example.com/ccs/download",
+			SystemContentPrefixURL:         "https://uk.example.com/ccs/download",
+			SystemUncachedContentPrefixURL: "https://uk.example.com/ccs/download",
+		}},
+		// Each override applies in turn, with region and country together taking precedence.
+		{"region and country", "EUR", "GB", ServiceURLs{
+			EcsURL:                         "https://uk.example.com/ecs",
+			IasURL:                         "https://eu.example.com/ias",
+			CasURL:                         "http://cas.example.com/cas/services/CatalogingSOAP",
+			NusURL:                         "https://nus.example.org/nus/services/NetUpdateSOAP",
+			ContentPrefixURL:               "https://gb.example.com/ccs/download",
+			UncachedContentPrefixURL:       "https://eu.example.com/uncached",
+			SystemContentPrefixURL:         "https://gb.example.com/ccs/download",
+			SystemUncachedContentPrefixURL: "https://eu.example.com/uncached",
+		}},
+	}
+	for _, c := range cases {
+		if urls := config.ServiceURLs(c.Region, c.Country); urls != c.Expected {
+			t.Errorf("%s: returned %+v, expected %+v", c.Name, urls, c.Expected)
+		}
+	}
+}
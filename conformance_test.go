@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite golden responses with actual output")
+
+// These describe the console registered within the test database.
+const (
+	testDeviceId    = 4362227770
+	testAccountId   = 123456789
+	testDeviceToken = "kR7ooWUFOJqWL8UKMoR9E"
+	testDeviceCode  = 1234567890123516
+)
+
+// testTime is used in place of the current time within responses.
+var testTime = time.Date(2021, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+// conformanceCase describes a request within testdata/conformance/<Service>/<Name>.request.xml,
+// and its expected response within <Name>.response.xml.
+//
+// Requests are written by hand, following those the Wii Shop Channel sends. Responses are not recorded
+// from Nintendo's servers, but are our own output as accepted via -update after review. They therefore
+// guard against regressions, rather than proving conformance with the original service.
+type conformanceCase struct {
+	Service string
+	Action  string
+	Name    string
+	Status  int
+
+	// Masked lists elements whose contents are random, and are not compared.
+	Masked []string
+
+	// Users, OwnedTitles, Bans and Challenges are added to the test database beforehand.
+	Users       []memoryUser
+	OwnedTitles []memoryOwnedTitle
+	Bans        []memoryBan
+	Challenges  []memoryChallenge
+
+	// Configure optionally alters the configuration for this case.
+	Configure func(config *Config)
+}
+
+// testChallenge is issued to consoles within conformance cases in strict mode, expiring at testChallengeExpiry.
+const testChallenge = "aBcDeFgHiJk"
+
+var testChallengeExpiry = testTime.Add(5 * time.Minute)
+
+const testCertifiedDeviceToken = "cE9MkDRWBvFm3q9pXzTnL"
+
+// testCertifiedUser is registered with a certificate issued by the test MS key. Its signatures
+// within conformance cases are of testChallenge, using its Hollywood ID as its private key.
+var testCertifiedUser = memoryUser{
+	DeviceId:          4362227771,
+	DeviceTokenHashed: fmt.Sprintf("%x", md5.Sum([]byte(testCertifiedDeviceToken))),
+	AccountId:         987654321,
+	Region:            "USA",
+	Country:           "US",
+	Language:          "en",
+	SerialNumber:      "LU521023243",
+	DeviceCode:        1234567890124196,
+	TokenIssued:       testTime,
+	DeviceCert:        newTestDeviceCertificate(0x0402503b, DefaultDeviceCertificateIssuer),
+
+	DeviceCertVerified: true,
+}
+
+// testReregisteredUser is the test console registered again with another serial number, such as after its NAND
+// was restored onto another console. Its token was issued after that of the original registration.
+var testReregisteredUser = memoryUser{
+	DeviceId:          testDeviceId,
+	DeviceTokenHashed: fmt.Sprintf("%x", md5.Sum([]byte("rE8nWbQ2xKpT5vLmZ7cYd"))),
+	AccountId:         123456790,
+	Region:            "USA",
+	Country:           "US",
+	Language:          "en",
+	SerialNumber:      "LU521023243",
+	DeviceCode:        1234567890124196,
+	TokenIssued:       testTime.Add(time.Minute),
+}
+
+// testOtherAccountToken is held by testOtherAccount.
+const testOtherAccountToken = "oT4hXaZ9qLmW2cVbN6yRs"
+
+// testOtherAccount was registered by another client under the test console's device ID, with another locale.
+var testOtherAccount = memoryUser{
+	DeviceId:          testDeviceId,
+	DeviceTokenHashed: fmt.Sprintf("%x", md5.Sum([]byte(testOtherAccountToken))),
+	AccountId:         123456791,
+	Region:            "EUR",
+	Country:           "GB",
+	Language:          "en",
+	SerialNumber:      "LEH123456784",
+	DeviceCode:        1234567890124196,
+	TokenIssued:       testTime.Add(-time.Hour),
+}
+
+// testUncertifiedAccount was registered under the certified test console's device ID, with another locale,
+// presenting a certificate which was not verified.
+var testUncertifiedAccount = memoryUser{
+	DeviceId:          testCertifiedUser.DeviceId,
+	DeviceTokenHashed: fmt.Sprintf("%x", md5.Sum([]byte(testOtherAccountToken))),
+	AccountId:         987654322,
+	Region:            "EUR",
+	Country:           "GB",
+	Language:          "en",
+	SerialNumber:      "LEH123456784",
+	DeviceCode:        1234567890124197,
+	TokenIssued:       testTime.Add(-time.Hour),
+	DeviceCert:        testCertifiedUser.DeviceCert,
+}
+
+// testRevocationDate is when revoked tickets within conformance cases were revoked.
+var testRevocationDate = time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// testBanExpiry is when temporary bans within conformance cases are lifted.
+var testBanExpiry = time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+var conformanceCases = []conformanceCase{
+	{Service: "ecs", Action: "CheckDeviceStatus", Status: http.StatusOK},
+	{Service: "ecs", Action: "CheckDeviceStatus", Name: "CheckDeviceStatus.unauthorized", Status: http.StatusUnauthorized},
+	{Service: "ecs", Action: "CheckDeviceStatus", Name: "CheckDeviceStatus.banned", Status: http.StatusInternalServerError, Bans: []memoryBan{
+		{Kind: BanSerialNumber, Value: "LU521023236", Reason: "Cheating.", Expires: &testBanExpiry, Created: testTime},
+	}},
+	{Service: "ecs", Action: "NotifyETicketsSynced", Status: http.StatusOK},
+	{Service: "ecs", Action: "ListETickets", Status: http.StatusOK},
+	{Service: "ecs", Action: "ListETickets", Name: "ListETickets.revoked", Status: http.StatusOK, OwnedTitles: []memoryOwnedTitle{
+		{AccountId: testAccountId, TicketId: "0001000148414242", TitleId: "0001000148414242", Version: 1, RevocationDate: &testRevocationDate},
+	}},
+	{Service: "ecs", Action: "GetETickets", Status: http.StatusOK},
+	{Service: "ecs", Action: "PurchaseTitle", Status: http.StatusOK},
+	{Service: "ecs", Action: "GetECConfig", Status: http.StatusOK},
+	{Service: "ecs", Action: "ListPurchaseHistory", Status: http.StatusOK},
+	{Service: "ias", Action: "CheckRegistration", Status: http.StatusOK},
+	{Service: "ias", Action: "CheckRegistration", Name: "CheckRegistration.unregistered", Status: http.StatusOK},
+	{Service: "ias", Action: "CheckRegistration", Name: "CheckRegistration.transferred", Status: http.StatusOK},
+	// Consoles registered several times are considered to hold the account most recently issued a token.
+	{Service: "ias", Action: "CheckRegistration", Name: "CheckRegistration.reregistered", Status: http.StatusOK, Users: []memoryUser{testReregisteredUser}},
+	{Service: "ias", Action: "CheckRegistration", Name: "CheckRegistration.banned", Status: http.StatusOK, Bans: []memoryBan{
+		{Kind: BanSerialNumber, Value: "LU521023243", Created: testTime},
+	}},
+	{Service: "ias", Action: "GetChallenge", Status: http.StatusOK},
+	{Service: "ias", Action: "GetChallenge", Name: "GetChallenge.strict", Status: http.StatusOK, Masked: []string{"Challenge"}, Configure: strictChallenges},
+	{Service: "ias", Action: "GetRegistrationInfo", Status: http.StatusOK, Masked: []string{"DeviceToken"}},
+	// Tokens are issued for the account authenticated as, not whichever has the locale presented.
+	{Service: "ias", Action: "GetRegistrationInfo", Name: "GetRegistrationInfo.other-account", Status: http.StatusOK, Masked: []string{"DeviceToken"}, Users: []memoryUser{testOtherAccount}},
+	// Anyone may claim to be a console within SyncRegistration, so only signed challenges are issued tokens.
+	{Service: "ias", Action: "SyncRegistration", Status: http.StatusOK},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.reregistered", Status: http.StatusOK, Users: []memoryUser{testReregisteredUser}},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.unregistered", Status: http.StatusInternalServerError},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.challenge", Status: http.StatusOK, Configure: strictChallenges, Challenges: []memoryChallenge{
+		{DeviceId: testDeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.signed", Status: http.StatusOK, Masked: []string{"DeviceToken"}, Configure: strictChallenges, Users: []memoryUser{testCertifiedUser}, Challenges: []memoryChallenge{
+		{DeviceId: testCertifiedUser.DeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	// Signatures are only verified against the certificate of the account a token would be issued for.
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.signed.other-account", Status: http.StatusOK, Configure: strictChallenges, Users: []memoryUser{testCertifiedUser, testUncertifiedAccount}, Challenges: []memoryChallenge{
+		{DeviceId: testCertifiedUser.DeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.unsigned", Status: http.StatusInternalServerError, Configure: strictChallenges, Users: []memoryUser{testCertifiedUser}, Challenges: []memoryChallenge{
+		{DeviceId: testCertifiedUser.DeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.signed.banned", Status: http.StatusInternalServerError, Configure: strictChallenges, Users: []memoryUser{testCertifiedUser}, Challenges: []memoryChallenge{
+		{DeviceId: testCertifiedUser.DeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}, Bans: []memoryBan{
+		{Kind: BanDeviceId, Value: "4362227771", Reason: "Cheating.", Created: testTime},
+	}},
+	{Service: "ias", Action: "SyncRegistration", Name: "SyncRegistration.takeover", Status: http.StatusInternalServerError, Configure: strictChallenges, Users: []memoryUser{testCertifiedUser}, Challenges: []memoryChallenge{
+		{DeviceId: testCertifiedUser.DeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	{Service: "ias", Action: "Register", Status: http.StatusOK, Masked: []string{"AccountId", "DeviceToken"}},
+	{Service: "ias", Action: "Register", Name: "Register.duplicate", Status: http.StatusInternalServerError},
+	{Service: "ias", Action: "Register", Name: "Register.serial", Status: http.StatusInternalServerError},
+	{Service: "ias", Action: "Register", Name: "Register.locale", Status: http.StatusInternalServerError},
+	{Service: "ias", Action: "Register", Name: "Register.certificate", Status: http.StatusOK, Masked: []string{"AccountId", "DeviceToken"}, Configure: verifyTestCertificates},
+	{Service: "ias", Action: "Register", Name: "Register.certificate-mismatch", Status: http.StatusInternalServerError, Configure: verifyTestCertificates},
+	{Service: "ias", Action: "Register", Name: "Register.uncertified", Status: http.StatusInternalServerError, Configure: verifyTestCertificates},
+	{Service: "ias", Action: "Register", Name: "Register.challenge", Status: http.StatusOK, Masked: []string{"AccountId", "DeviceToken"}, Configure: strictChallenges, Challenges: []memoryChallenge{
+		{DeviceId: testDeviceId + 1, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	{Service: "ias", Action: "Register", Name: "Register.unchallenged", Status: http.StatusInternalServerError, Configure: strictChallenges, Challenges: []memoryChallenge{
+		{DeviceId: testDeviceId + 1, Challenge: testChallenge, Expires: testChallengeExpiry},
+	}},
+	{Service: "ias", Action: "Register", Name: "Register.banned", Status: http.StatusInternalServerError, Bans: []memoryBan{
+		{Kind: BanDeviceCode, Value: "1234567890124196", Created: testTime},
+	}},
+	{Service: "ias", Action: "Unregister", Status: http.StatusOK},
+}
+
+// verifyTestCertificates requires device certificates issued by the test MS key.
+func verifyTestCertificates(config *Config) {
+	config.DeviceCertificates.MSPublicKey = testMSPublicKey()
+}
+
+// strictChallenges requires consoles to return challenges issued to them.
+func strictChallenges(config *Config) {
+	config.Challenges.Strict = true
+}
+
+// newTestDatabase returns an in-memory database containing a single registered console.
+func newTestDatabase() *memoryDatabase {
+	database := newMemoryDatabase()
+	database.users = []memoryUser{
+		{
+			DeviceId:          testDeviceId,
+			DeviceTokenHashed: fmt.Sprintf("%x", md5.Sum([]byte(testDeviceToken))),
+			AccountId:         testAccountId,
+			Region:            "USA",
+			Country:           "US",
+			Language:          "en",
+			SerialNumber:      "LU521023236",
+			DeviceCode:        testDeviceCode,
+			TokenIssued:       testTime,
+		},
+	}
+	database.ownedTitles = []memoryOwnedTitle{
+		{
+			AccountId: testAccountId,
+			TicketId:  "0001000148414241",
+			TitleId:   "0001000148414241",
+			Version:   2,
+		},
+	}
+
+	return database
+}
+
+// setupTestServer configures global state as main would, with consistent output.
+func setupTestServer(t testing.TB) {
+	previousLogger := logger
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	now = func() time.Time {
+		return testTime
+	}
+	config := defaultConfig()
+	config.BaseURL = "example.com"
+	config.Debug = true
+	currentConfig.Store(&config)
+	db = newTestDatabase()
+	verifiedTokens = newAuthCache()
+	limiter = newRateLimiter()
+
+	t.Cleanup(func() {
+		now = time.Now
+		logger = previousLogger
+	})
+}
+
+// maskElements replaces the contents of the given elements with an asterisk.
+func maskElements(document string, elements []string) string {
+	for _, element := range elements {
+		expression := regexp.MustCompile(`(<` + element + `>)[^<]*(</` + element + `>)`)
+		document = expression.ReplaceAllString(document, "${1}*${2}")
+	}
+
+	return document
+}
+
+// soapRequest returns a request as the console would send it for the given action.
+func soapRequest(service string, action string, body []byte) *http.Request {
+	request := httptest.NewRequest("POST", "/"+service+"/services/"+services[service]+"SOAP", bytes.NewReader(body))
+	request.Header.Set("SOAPAction", "urn:"+service+".wsapi.broadon.com/"+action)
+	request.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	return request
+}
+
+// conformanceDatabase returns the database to handle a case with, holding the test console and the case's fixtures.
+type conformanceDatabase func(t *testing.T, c conformanceCase) Database
+
+// TestConformance runs every case against the in-memory database. Should the environment name a PostgreSQL
+// database, TestPostgreSQL additionally runs them against one, ensuring our statements agree with the schema.
+func TestConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T, c conformanceCase) Database {
+		database := newTestDatabase()
+		database.users = append(database.users, c.Users...)
+		database.bans = c.Bans
+		database.ownedTitles = append(database.ownedTitles, c.OwnedTitles...)
+		database.challenges = c.Challenges
+		return database
+	})
+}
+
+// runConformance sends every case's request, comparing our response against its golden file.
+func runConformance(t *testing.T, newDatabase conformanceDatabase) {
+	setupTestServer(t)
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	for _, c := range conformanceCases {
+		c := c
+		if c.Name == "" {
+			c.Name = c.Action
+		}
+
+		t.Run(c.Service+"/"+c.Name, func(t *testing.T) {
+			config := *settings()
+			if c.Configure != nil {
+				c.Configure(&config)
+			}
+			previous := currentConfig.Swap(&config)
+			defer currentConfig.Store(previous)
+
+			db = newDatabase(t, c)
+			verifiedTokens = newAuthCache()
+			limiter = newRateLimiter()
+			directory := filepath.Join("testdata", "conformance", c.Service)
+
+			body, err := os.ReadFile(filepath.Join(directory, c.Name+".request.xml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, soapRequest(c.Service, c.Action, body))
+			if recorder.Code != c.Status {
+				t.Errorf("status %d, expected %d", recorder.Code, c.Status)
+			}
+
+			actual := maskElements(recorder.Body.String(), c.Masked)
+			goldenPath := filepath.Join(directory, c.Name+".response.xml")
+			if *update {
+				err = os.WriteFile(goldenPath, []byte(actual), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			expected, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := diffLines(strings.Split(string(expected), "\n"), strings.Split(actual, "\n")); diff != nil {
+				t.Errorf("response differs from %s (run with -update to accept):\n%s", goldenPath, strings.Join(diff, "\n"))
+			}
+		})
+	}
+}
@@ -20,6 +20,55 @@ SET default_tablespace = '';
 
 SET default_table_access_method = heap;
 
+--
+-- Name: bans; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.bans (
+                             kind character varying(16) NOT NULL,
+                             value character varying(20) NOT NULL,
+                             reason text,
+                             expires timestamp without time zone,
+                             created timestamp without time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.bans OWNER TO wiisoap;
+
+--
+-- Name: TABLE bans; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON TABLE public.bans IS 'Consoles and accounts refused service. Kind is one of device_id, serial_number, device_code or account_id.';
+
+
+--
+-- Name: COLUMN bans.expires; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON COLUMN public.bans.expires IS 'When the ban is lifted, in UTC, or null if permanent.';
+
+
+--
+-- Name: challenges; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.challenges (
+                                   device_id bigint NOT NULL,
+                                   challenge character varying(11) NOT NULL,
+                                   expires timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.challenges OWNER TO wiisoap;
+
+--
+-- Name: TABLE challenges; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON TABLE public.challenges IS 'Challenges issued by GetChallenge in strict mode, awaiting their return. Expiry is in UTC.';
+
+
 --
 -- Name: owned_titles; Type: TABLE; Schema: public; Owner: wiisoap
 --
@@ -34,6 +83,31 @@ CREATE TABLE public.owned_titles (
 
 ALTER TABLE public.owned_titles OWNER TO wiisoap;
 
+--
+-- Name: schema_version; Type: TABLE; Schema: public; Owner: wiisoap
+--
+
+CREATE TABLE public.schema_version (
+                                       version integer NOT NULL
+);
+
+
+ALTER TABLE public.schema_version OWNER TO wiisoap;
+
+--
+-- Name: TABLE schema_version; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON TABLE public.schema_version IS 'Version of this schema, checked by WiiSOAP for readiness.';
+
+
+--
+-- Data for Name: schema_version; Type: TABLE DATA; Schema: public; Owner: wiisoap
+--
+
+INSERT INTO public.schema_version (version) VALUES (9);
+
+
 --
 -- Name: shop_titles; Type: TABLE; Schema: public; Owner: wiisoap
 --
@@ -60,14 +134,16 @@ COMMENT ON COLUMN public.shop_titles.description IS 'Description of the title.';
 
 CREATE TABLE public.userbase (
                                  device_id bigint NOT NULL,
-                                 device_token character varying(21) NOT NULL,
                                  device_token_hashed character varying(32) NOT NULL,
                                  account_id integer NOT NULL,
                                  region character varying(3),
                                  country character varying(2),
                                  language character varying(2),
-                                 serial_number character varying(11),
-                                 device_code bigint
+                                 serial_number character varying(12),
+                                 device_code bigint,
+                                 device_token_issued timestamp without time zone DEFAULT now() NOT NULL,
+                                 device_cert bytea,
+                                 device_cert_verified boolean DEFAULT false NOT NULL
 );
 
 
@@ -80,6 +156,43 @@ ALTER TABLE public.userbase OWNER TO wiisoap;
 COMMENT ON COLUMN public.userbase.device_code IS 'Also known as the console''s friend code.';
 
 
+--
+-- Name: COLUMN userbase.device_token_issued; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON COLUMN public.userbase.device_token_issued IS 'When the current device token was issued, in UTC.';
+
+
+--
+-- Name: COLUMN userbase.device_cert; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON COLUMN public.userbase.device_cert IS 'Device certificate presented upon registering, allowing eTickets to be personalised.';
+
+
+--
+-- Name: COLUMN userbase.device_cert_verified; Type: COMMENT; Schema: public; Owner: wiisoap
+--
+
+COMMENT ON COLUMN public.userbase.device_cert_verified IS 'Whether device_cert was verified against the MS public key upon registering, and may prove the console''s identity.';
+
+
+--
+-- Name: bans bans_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.bans
+    ADD CONSTRAINT bans_pk PRIMARY KEY (kind, value);
+
+
+--
+-- Name: challenges challenges_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
+--
+
+ALTER TABLE ONLY public.challenges
+    ADD CONSTRAINT challenges_pk PRIMARY KEY (device_id, challenge);
+
+
 --
 -- Name: owned_titles owned_titles_pk; Type: CONSTRAINT; Schema: public; Owner: wiisoap
 --
@@ -133,10 +246,10 @@ CREATE UNIQUE INDEX userbase_device_code_uindex ON public.userbase USING btree (
 
 
 --
--- Name: userbase_device_token_uindex; Type: INDEX; Schema: public; Owner: wiisoap
+-- Name: userbase_device_token_hashed_uindex; Type: INDEX; Schema: public; Owner: wiisoap
 --
 
-CREATE UNIQUE INDEX userbase_device_token_uindex ON public.userbase USING btree (device_token);
+CREATE UNIQUE INDEX userbase_device_token_hashed_uindex ON public.userbase USING btree (device_token_hashed);
 
 
 --
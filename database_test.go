@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memoryUser represents a row within userbase.
+type memoryUser struct {
+	DeviceId          int64
+	DeviceTokenHashed string
+	AccountId         int64
+	Region            string
+	Country           string
+	Language          string
+	SerialNumber      string
+	DeviceCode        int64
+	TokenIssued       time.Time
+	DeviceCert        []byte
+
+	// DeviceCertVerified is set if DeviceCert was verified against the MS public key upon registering.
+	DeviceCertVerified bool
+}
+
+// memoryOwnedTitle represents a row within owned_titles, joined with shop_titles.
+type memoryOwnedTitle struct {
+	AccountId      int64
+	TicketId       string
+	TitleId        string
+	Version        int
+	RevocationDate *time.Time
+}
+
+// memoryBan represents a row within bans.
+type memoryBan struct {
+	Kind    string
+	Value   string
+	Reason  string
+	Expires *time.Time
+	Created time.Time
+}
+
+// active returns whether the ban is in effect at the given time.
+func (b memoryBan) active(at time.Time) bool {
+	return b.Expires == nil || b.Expires.After(at)
+}
+
+func (b memoryBan) values() []interface{} {
+	return []interface{}{b.Kind, b.Value, b.Reason, b.Expires, b.Created}
+}
+
+// memoryChallenge represents a row within challenges.
+type memoryChallenge struct {
+	DeviceId  int64
+	Challenge string
+	Expires   time.Time
+}
+
+// memoryDatabase implements Database in-process, understanding only the statements WiiSOAP issues.
+// It mirrors our SQL by hand, so TestPostgreSQL runs the same cases against PostgreSQL to catch divergence.
+type memoryDatabase struct {
+	mu          sync.Mutex
+	users       []memoryUser
+	ownedTitles []memoryOwnedTitle
+	bans        []memoryBan
+	challenges  []memoryChallenge
+}
+
+func newMemoryDatabase() *memoryDatabase {
+	return &memoryDatabase{}
+}
+
+// uniqueViolation mirrors the error PostgreSQL returns upon violating the named unique index.
+func uniqueViolation(constraint string) *pgconn.PgError {
+	return &pgconn.PgError{
+		Code:           "23505",
+		Message:        "duplicate key value violates unique constraint \"" + constraint + "\"",
+		ConstraintName: constraint,
+	}
+}
+
+func (m *memoryDatabase) Exec(_ context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch sql {
+	case PrepareUserStatement:
+		user := memoryUser{
+			DeviceId:          toInt64(args[0]),
+			DeviceTokenHashed: args[1].(string),
+			AccountId:         toInt64(args[2]),
+			Region:            args[3].(string),
+			Country:           args[4].(string),
+			Language:          args[5].(string),
+			SerialNumber:      args[6].(string),
+			DeviceCode:        toInt64(args[7]),
+			TokenIssued:       args[8].(time.Time),
+			DeviceCert:        args[9].([]byte),
+
+			DeviceCertVerified: args[10].(bool),
+		}
+		for _, existing := range m.users {
+			switch {
+			case existing.AccountId == user.AccountId:
+				return nil, uniqueViolation("userbase_pk")
+			case existing.DeviceCode == user.DeviceCode:
+				return nil, uniqueViolation("userbase_device_code_uindex")
+			case existing.DeviceTokenHashed == user.DeviceTokenHashed:
+				return nil, uniqueViolation("userbase_device_token_hashed_uindex")
+			}
+		}
+		m.users = append(m.users, user)
+		return pgconn.CommandTag("INSERT 0 1"), nil
+	case UpdateTokenStatement:
+		// As within PostgreSQL, no two rows may be left with the same token.
+		var matched []int
+		for i, user := range m.users {
+			if user.AccountId == toInt64(args[2]) {
+				matched = append(matched, i)
+			} else if user.DeviceTokenHashed == args[0] {
+				return nil, uniqueViolation("userbase_device_token_hashed_uindex")
+			}
+		}
+		for _, i := range matched {
+			m.users[i].DeviceTokenHashed = args[0].(string)
+			m.users[i].TokenIssued = args[1].(time.Time)
+		}
+		return pgconn.CommandTag(fmt.Sprintf("UPDATE %d", len(matched))), nil
+	case IssueChallengeStatement:
+		challenge := memoryChallenge{
+			DeviceId:  toInt64(args[0]),
+			Challenge: args[1].(string),
+			Expires:   args[2].(time.Time),
+		}
+		m.challenges = append(m.challenges, challenge)
+		return pgconn.CommandTag("INSERT 0 1"), nil
+	case PurgeChallengesStatement:
+		// Of those unexpired, only the $3 expiring last are kept.
+		var kept []memoryChallenge
+		for _, existing := range m.challenges {
+			if existing.DeviceId == toInt64(args[0]) && existing.Expires.After(args[1].(time.Time)) {
+				kept = append(kept, existing)
+			}
+		}
+		sort.SliceStable(kept, func(i, j int) bool {
+			return kept[i].Expires.After(kept[j].Expires)
+		})
+		if len(kept) > args[2].(int) {
+			kept = kept[:args[2].(int)]
+		}
+		remaining := kept
+		for _, existing := range m.challenges {
+			if existing.DeviceId != toInt64(args[0]) {
+				remaining = append(remaining, existing)
+			}
+		}
+		purged := len(m.challenges) - len(remaining)
+		m.challenges = remaining
+		return pgconn.CommandTag(fmt.Sprintf("DELETE %d", purged)), nil
+	case ConsumeChallengeStatement:
+		for i, existing := range m.challenges {
+			if existing.DeviceId == toInt64(args[0]) && existing.Challenge == args[1] && existing.Expires.After(args[2].(time.Time)) {
+				m.challenges = append(m.challenges[:i], m.challenges[i+1:]...)
+				return pgconn.CommandTag("DELETE 1"), nil
+			}
+		}
+		return pgconn.CommandTag("DELETE 0"), nil
+	case AddBanStatement:
+		ban := memoryBan{
+			Kind:    args[0].(string),
+			Value:   args[1].(string),
+			Reason:  args[2].(string),
+			Expires: args[3].(*time.Time),
+			Created: args[4].(time.Time),
+		}
+		for i, existing := range m.bans {
+			if existing.Kind == ban.Kind && existing.Value == ban.Value {
+				m.bans[i] = ban
+				return pgconn.CommandTag("INSERT 0 1"), nil
+			}
+		}
+		m.bans = append(m.bans, ban)
+		return pgconn.CommandTag("INSERT 0 1"), nil
+	case RemoveBanStatement:
+		for i, existing := range m.bans {
+			if existing.Kind == args[0] && existing.Value == args[1] {
+				m.bans = append(m.bans[:i], m.bans[i+1:]...)
+				return pgconn.CommandTag("DELETE 1"), nil
+			}
+		}
+		return pgconn.CommandTag("DELETE 0"), nil
+	}
+
+	return nil, unsupported(sql)
+}
+
+func (m *memoryDatabase) Query(_ context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch sql {
+	case QueryOwnedTitles:
+		rows := &memoryRows{}
+		for _, title := range m.ownedTitles {
+			if title.AccountId == toInt64(args[0]) {
+				revocationDate := 0
+				if title.RevocationDate != nil {
+					revocationDate = int(title.RevocationDate.UnixMilli())
+				}
+				rows.values = append(rows.values, []interface{}{title.TicketId, title.TitleId, title.Version, revocationDate})
+			}
+		}
+		return rows, nil
+	case QueryDeviceAccountsStatement:
+		rows := &memoryRows{}
+		for _, user := range m.users {
+			if user.DeviceId == toInt64(args[0]) {
+				rows.values = append(rows.values, []interface{}{user.AccountId})
+			}
+		}
+		return rows, nil
+	case ListBansStatement:
+		rows := &memoryRows{}
+		for _, ban := range m.bans {
+			if ban.active(args[0].(time.Time)) {
+				rows.values = append(rows.values, ban.values())
+			}
+		}
+		return rows, nil
+	}
+
+	return nil, unsupported(sql)
+}
+
+func (m *memoryDatabase) QueryRow(_ context.Context, sql string, args ...interface{}) pgx.Row {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch sql {
+	case SyncUserStatement:
+		user, ok := m.latestUser(func(user memoryUser) bool {
+			return user.Language == args[0] && user.Country == args[1] && user.Region == args[2] && user.DeviceId == toInt64(args[3])
+		})
+		if ok {
+			var deviceCert []byte
+			if user.DeviceCertVerified {
+				deviceCert = user.DeviceCert
+			}
+			return memoryRow{values: []interface{}{user.AccountId, user.TokenIssued, deviceCert}}
+		}
+		return memoryRow{err: pgx.ErrNoRows}
+	case SyncAccountStatement:
+		for _, user := range m.users {
+			if user.AccountId == toInt64(args[0]) && user.DeviceId == toInt64(args[1]) {
+				return memoryRow{values: []interface{}{user.TokenIssued}}
+			}
+		}
+		return memoryRow{err: pgx.ErrNoRows}
+	case RouteVerifyStatement:
+		for _, user := range m.users {
+			if user.AccountId == toInt64(args[0]) && user.DeviceId == toInt64(args[1]) {
+				return memoryRow{values: []interface{}{user.DeviceTokenHashed, user.TokenIssued}}
+			}
+		}
+		return memoryRow{err: pgx.ErrNoRows}
+	case CheckRegistrationStatement:
+		user, ok := m.latestUser(func(user memoryUser) bool {
+			return user.DeviceId == toInt64(args[0])
+		})
+		if ok {
+			return memoryRow{values: []interface{}{user.SerialNumber}}
+		}
+		return memoryRow{err: pgx.ErrNoRows}
+	case QueryBanStatement:
+		// Identifiers registered to the device are also considered.
+		identifiers := map[string]string{
+			BanDeviceId:     args[1].(string),
+			BanAccountId:    args[2].(string),
+			BanSerialNumber: args[3].(string),
+			BanDeviceCode:   args[4].(string),
+		}
+		var registered []memoryUser
+		for _, user := range m.users {
+			if user.DeviceId == toInt64(args[5]) {
+				registered = append(registered, user)
+			}
+		}
+
+		var found *memoryBan
+		for i, ban := range m.bans {
+			if !ban.active(args[0].(time.Time)) {
+				continue
+			}
+
+			matches := identifiers[ban.Kind] == ban.Value
+			for _, user := range registered {
+				switch ban.Kind {
+				case BanAccountId:
+					matches = matches || strconv.FormatInt(user.AccountId, 10) == ban.Value
+				case BanSerialNumber:
+					matches = matches || user.SerialNumber == ban.Value
+				case BanDeviceCode:
+					matches = matches || strconv.FormatInt(user.DeviceCode, 10) == ban.Value
+				}
+			}
+
+			// Permanent bans are preferred, followed by those lasting longest.
+			if matches && (found == nil || (found.Expires != nil && (ban.Expires == nil || ban.Expires.After(*found.Expires)))) {
+				found = &m.bans[i]
+			}
+		}
+		if found == nil {
+			return memoryRow{err: pgx.ErrNoRows}
+		}
+		return memoryRow{values: found.values()}
+	case QuerySchemaVersion:
+		return memoryRow{values: []interface{}{SchemaVersion}}
+	}
+
+	return memoryRow{err: unsupported(sql)}
+}
+
+// latestUser returns the matching user most recently issued a token, as statements ordering by device_token_issued do.
+func (m *memoryDatabase) latestUser(match func(user memoryUser) bool) (memoryUser, bool) {
+	var latest memoryUser
+	found := false
+	for _, user := range m.users {
+		if match(user) && (!found || user.TokenIssued.After(latest.TokenIssued)) {
+			latest, found = user, true
+		}
+	}
+	return latest, found
+}
+
+func (m *memoryDatabase) Ping(_ context.Context) error {
+	return nil
+}
+
+func unsupported(sql string) error {
+	return fmt.Errorf("memoryDatabase: unsupported statement %q", sql)
+}
+
+// toInt64 converts integer arguments as PostgreSQL would for bigint columns.
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case string:
+		parsed, _ := strconv.ParseInt(v, 10, 64)
+		return parsed
+	}
+
+	panic(fmt.Sprintf("memoryDatabase: unexpected argument type %T", value))
+}
+
+// scanInto assigns values to the given destinations, converting between numeric types as necessary.
+func scanInto(values []interface{}, dest []interface{}) error {
+	if len(values) != len(dest) {
+		return fmt.Errorf("memoryDatabase: %d values scanned into %d destinations", len(values), len(dest))
+	}
+
+	for i, value := range values {
+		target := reflect.ValueOf(dest[i]).Elem()
+		source := reflect.ValueOf(value)
+		if !source.Type().ConvertibleTo(target.Type()) {
+			return fmt.Errorf("memoryDatabase: cannot scan %T into %s", value, target.Type())
+		}
+		target.Set(source.Convert(target.Type()))
+	}
+
+	return nil
+}
+
+// memoryRow implements pgx.Row.
+type memoryRow struct {
+	values []interface{}
+	err    error
+}
+
+func (r memoryRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	return scanInto(r.values, dest)
+}
+
+// memoryRows implements pgx.Rows.
+type memoryRows struct {
+	values  [][]interface{}
+	current int
+}
+
+func (r *memoryRows) Close() {}
+
+func (r *memoryRows) Err() error {
+	return nil
+}
+
+func (r *memoryRows) CommandTag() pgconn.CommandTag {
+	return pgconn.CommandTag(fmt.Sprintf("SELECT %d", len(r.values)))
+}
+
+func (r *memoryRows) FieldDescriptions() []pgproto3.FieldDescription {
+	return nil
+}
+
+func (r *memoryRows) Next() bool {
+	if r.current >= len(r.values) {
+		return false
+	}
+
+	r.current++
+	return true
+}
+
+func (r *memoryRows) Scan(dest ...interface{}) error {
+	if r.current == 0 {
+		return errors.New("memoryDatabase: Scan called without Next")
+	}
+
+	return scanInto(r.values[r.current-1], dest)
+}
+
+func (r *memoryRows) Values() ([]interface{}, error) {
+	return r.values[r.current-1], nil
+}
+
+func (r *memoryRows) RawValues() [][]byte {
+	return nil
+}
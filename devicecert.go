@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultDeviceCertificateIssuer is the issuer retail consoles' certificates name.
+	DefaultDeviceCertificateIssuer = "Root-CA00000001-MS00000002"
+
+	// DeviceCertificateSize is the size of a device certificate, as within the console's NAND.
+	DeviceCertificateSize = 0x180
+
+	// Certificates signed with ECDSA over sect233r1, holding a sect233r1 public key.
+	signatureTypeECC = 0x00010002
+	keyTypeECC       = 2
+
+	// Offsets within device certificates. The signature covers everything from the issuer onwards.
+	certSignatureOffset = 0x04
+	certIssuerOffset    = 0x80
+	certKeyTypeOffset   = 0xc0
+	certNameOffset      = 0xc4
+	certKeyIdOffset     = 0x104
+	certPublicKeyOffset = 0x108
+	certNameSize        = 0x40
+)
+
+// DeviceCertificate is the certificate identifying a console, issued by Nintendo's MS for its NG key.
+type DeviceCertificate struct {
+	Issuer    string
+	Name      string
+	KeyId     uint32
+	PublicKey []byte
+	Signature []byte
+
+	raw []byte
+}
+
+// parseDeviceCertificate decodes a device certificate, without verifying its signature.
+func parseDeviceCertificate(raw []byte) (*DeviceCertificate, error) {
+	if len(raw) != DeviceCertificateSize {
+		return nil, fmt.Errorf("device certificate is %d bytes, not %d", len(raw), DeviceCertificateSize)
+	}
+	if binary.BigEndian.Uint32(raw) != signatureTypeECC {
+		return nil, errors.New("device certificate is not signed with ECC")
+	}
+	if binary.BigEndian.Uint32(raw[certKeyTypeOffset:]) != keyTypeECC {
+		return nil, errors.New("device certificate does not hold an ECC key")
+	}
+
+	return &DeviceCertificate{
+		Issuer:    nullTerminated(raw[certIssuerOffset : certIssuerOffset+certNameSize]),
+		Name:      nullTerminated(raw[certNameOffset : certNameOffset+certNameSize]),
+		KeyId:     binary.BigEndian.Uint32(raw[certKeyIdOffset:]),
+		PublicKey: raw[certPublicKeyOffset : certPublicKeyOffset+2*fieldElementSize],
+		Signature: raw[certSignatureOffset : certSignatureOffset+2*fieldElementSize],
+		raw:       raw,
+	}, nil
+}
+
+func nullTerminated(field []byte) string {
+	if end := bytes.IndexByte(field, 0); end != -1 {
+		field = field[:end]
+	}
+	return string(field)
+}
+
+// MatchesDevice checks that the certificate is that of the console with deviceId.
+// Consoles are named after their Hollywood ID, such as NG0403ac68.
+func (c *DeviceCertificate) MatchesDevice(deviceId int) error {
+	expected := fmt.Sprintf("NG%08x", deviceId&0xffffffff)
+	if c.Name != expected {
+		return fmt.Errorf("device certificate is for %s, not %s", c.Name, expected)
+	}
+	return nil
+}
+
+// Verify checks that the certificate was signed by the given issuer, whose public key is key.
+func (c *DeviceCertificate) Verify(issuer string, key curvePoint) error {
+	if c.Issuer != issuer {
+		return fmt.Errorf("device certificate is issued by %s, not %s", c.Issuer, issuer)
+	}
+
+	hash := sha1.Sum(c.raw[certIssuerOffset:])
+	if !verifyECDSA(key, hash[:], c.Signature) {
+		return errors.New("device certificate signature is invalid")
+	}
+	return nil
+}
+
+// publicKey returns the configured MS public key, or false if device certificates are not verified.
+func (d *DeviceCertificates) publicKey() (curvePoint, bool, error) {
+	if d.MSPublicKey == "" {
+		return curvePoint{}, false, nil
+	}
+
+	encoded, err := hex.DecodeString(strings.TrimSpace(d.MSPublicKey))
+	if err != nil {
+		return curvePoint{}, false, err
+	}
+	key, err := parseECCPublicKey(encoded)
+	return key, true, err
+}
+
+// registrationCertificate returns the device certificate presented within Register, or nil if none was,
+// and whether it was verified. Certificates must always be for the registering console, but are only required,
+// and their signatures verified, if an MS public key is configured. Anyone may create a certificate otherwise,
+// so those not verified must never be relied upon to prove a console's identity.
+func registrationCertificate(e *Envelope) ([]byte, bool, error) {
+	config := settings().DeviceCertificates
+	key, verify, err := config.publicKey()
+	if err != nil {
+		return nil, false, fmt.Errorf("MS public key is invalid: %w", err)
+	}
+
+	encoded, err := getKey(e.doc, "DeviceCert")
+	if err != nil {
+		if verify {
+			return nil, false, errors.New("no device certificate was presented")
+		}
+		return nil, false, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, false, errors.New("device certificate is not valid base64")
+	}
+	certificate, err := parseDeviceCertificate(raw)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = certificate.MatchesDevice(e.DeviceId())
+	if err != nil {
+		return nil, false, err
+	}
+	if verify {
+		err = certificate.Verify(config.Issuer, key)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return raw, verify, nil
+}
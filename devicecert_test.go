@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMSPrivateKey is a locally generated stand-in for the MS's private key, signing test certificates.
+var testMSPrivateKey, _ = new(big.Int).SetString("f733d8417374a6750f3a21eb99f1b888f0ef15a4d0504b1160a77ccf5", 16)
+
+// encodePublicKey encodes a point as the Wii stores public keys.
+func encodePublicKey(key curvePoint) []byte {
+	return append(key.X.bytes(), key.Y.bytes()...)
+}
+
+// testMSPublicKey returns the public key of testMSPrivateKey, as configured.
+func testMSPublicKey() string {
+	return hex.EncodeToString(encodePublicKey(curveGenerator.scalarMult(testMSPrivateKey)))
+}
+
+// signECDSA signs hash with privateKey using the given nonce, which must be secret and unique outside of tests.
+func signECDSA(privateKey *big.Int, hash []byte, nonce *big.Int) []byte {
+	r := new(big.Int).SetBytes(curveGenerator.scalarMult(nonce).X.bytes())
+	r.Mod(r, curveOrder)
+
+	s := new(big.Int).Mul(r, privateKey)
+	s.Add(s, new(big.Int).SetBytes(hash))
+	s.Mul(s, new(big.Int).ModInverse(nonce, curveOrder))
+	s.Mod(s, curveOrder)
+
+	return append(r.FillBytes(make([]byte, fieldElementSize)), s.FillBytes(make([]byte, fieldElementSize))...)
+}
+
+// newTestDeviceCertificate returns a certificate for the console with the given Hollywood ID,
+// issued by the given issuer using the test MS key. Output is deterministic.
+func newTestDeviceCertificate(hollywoodId uint32, issuer string) []byte {
+	raw := make([]byte, DeviceCertificateSize)
+	binary.BigEndian.PutUint32(raw, signatureTypeECC)
+	copy(raw[certIssuerOffset:], issuer)
+	binary.BigEndian.PutUint32(raw[certKeyTypeOffset:], keyTypeECC)
+	copy(raw[certNameOffset:], "NG"+hex.EncodeToString(binary.BigEndian.AppendUint32(nil, hollywoodId)))
+	binary.BigEndian.PutUint32(raw[certKeyIdOffset:], 0x12345678)
+
+	// The console's own key pair is irrelevant to verification.
+	ngKey := curveGenerator.scalarMult(big.NewInt(int64(hollywoodId)))
+	copy(raw[certPublicKeyOffset:], encodePublicKey(ngKey))
+
+	hash := sha1.Sum(raw[certIssuerOffset:])
+	copy(raw[certSignatureOffset:], signECDSA(testMSPrivateKey, hash[:], big.NewInt(int64(hollywoodId)+1)))
+	return raw
+}
+
+func TestCurveParameters(t *testing.T) {
+	if !curveGenerator.onCurve() {
+		t.Error("generator is not upon the curve")
+	}
+	if !curveGenerator.scalarMult(curveOrder).Infinity {
+		t.Error("generator does not have the curve's order")
+	}
+
+	element := curveGenerator.Y
+	if product := element.mul(element.inverse()); product != (fieldElement{1}) {
+		t.Errorf("element multiplied by its inverse is %x, not 1", product)
+	}
+}
+
+func TestVerifyECDSA(t *testing.T) {
+	key := curveGenerator.scalarMult(testMSPrivateKey)
+	hash := sha1.Sum([]byte("WiiSOAP"))
+	signature := signECDSA(testMSPrivateKey, hash[:], big.NewInt(1234567))
+
+	if !verifyECDSA(key, hash[:], signature) {
+		t.Fatal("valid signature was rejected")
+	}
+
+	otherHash := sha1.Sum([]byte("WiiSOAQ"))
+	if verifyECDSA(key, otherHash[:], signature) {
+		t.Error("signature was accepted for a different hash")
+	}
+	if verifyECDSA(curveGenerator, hash[:], signature) {
+		t.Error("signature was accepted for a different key")
+	}
+
+	tampered := append([]byte{}, signature...)
+	tampered[len(tampered)-1] ^= 1
+	if verifyECDSA(key, hash[:], tampered) {
+		t.Error("tampered signature was accepted")
+	}
+	if verifyECDSA(key, hash[:], make([]byte, len(signature))) {
+		t.Error("zero signature was accepted")
+	}
+}
+
+func TestParseECCPublicKey(t *testing.T) {
+	encoded, _ := hex.DecodeString(testMSPublicKey())
+	key, err := parseECCPublicKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != curveGenerator.scalarMult(testMSPrivateKey) {
+		t.Error("decoded key differs from that encoded")
+	}
+
+	encoded[len(encoded)-1] ^= 1
+	if _, err = parseECCPublicKey(encoded); err == nil {
+		t.Error("point not upon the curve was accepted")
+	}
+}
+
+func TestDeviceCertificate(t *testing.T) {
+	key := curveGenerator.scalarMult(testMSPrivateKey)
+	raw := newTestDeviceCertificate(0x0402503b, DefaultDeviceCertificateIssuer)
+
+	certificate, err := parseDeviceCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certificate.Name != "NG0402503b" || certificate.Issuer != DefaultDeviceCertificateIssuer {
+		t.Errorf("parsed name %q and issuer %q", certificate.Name, certificate.Issuer)
+	}
+	if err = certificate.MatchesDevice(4362227771); err != nil {
+		t.Error(err)
+	}
+	if err = certificate.MatchesDevice(4362227770); err == nil {
+		t.Error("certificate matched another console")
+	}
+	if err = certificate.Verify(DefaultDeviceCertificateIssuer, key); err != nil {
+		t.Error(err)
+	}
+	if err = certificate.Verify("Root-CA00000002-MS00000003", key); err == nil {
+		t.Error("certificate was accepted from another issuer")
+	}
+
+	// Altering anything signed must invalidate the certificate.
+	raw[certPublicKeyOffset] ^= 1
+	certificate, err = parseDeviceCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = certificate.Verify(DefaultDeviceCertificateIssuer, key); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("tampered certificate gave %v", err)
+	}
+
+	if _, err = parseDeviceCertificate(raw[:DeviceCertificateSize-1]); err == nil {
+		t.Error("truncated certificate was parsed")
+	}
+}
+
+func TestRegisterStoresDeviceCertificate(t *testing.T) {
+	setupTestServer(t)
+	body, err := os.ReadFile(filepath.Join("testdata", "conformance", "ias", "Register.certificate.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := newTestDeviceCertificate(0x0402503b, DefaultDeviceCertificateIssuer)
+
+	// Without the MS public key, anyone could have created the certificate presented.
+	cases := []struct {
+		Name      string
+		Configure func(config *Config)
+		Verified  bool
+	}{
+		{"verified", verifyTestCertificates, true},
+		{"unverified", func(config *Config) {}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			config := *settings()
+			c.Configure(&config)
+			previous := currentConfig.Swap(&config)
+			defer currentConfig.Store(previous)
+			database := newTestDatabase()
+			db = database
+
+			recorder := httptest.NewRecorder()
+			route := newServiceRoute()
+			route.Handle().ServeHTTP(recorder, soapRequest("ias", "Register", body))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			for _, user := range database.users {
+				if user.DeviceId == 4362227771 {
+					if !bytes.Equal(user.DeviceCert, expected) {
+						t.Error("stored certificate differs from that presented")
+					}
+					if user.DeviceCertVerified != c.Verified {
+						t.Errorf("stored certificate as verified %v", user.DeviceCertVerified)
+					}
+					return
+				}
+			}
+			t.Error("console was not registered")
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"math/bits"
+)
+
+// The Wii signs certificates with ECDSA over sect233r1, a binary curve the standard library lacks.
+// It is defined by SEC 2 as y^2 + xy = x^3 + x^2 + b over GF(2^233).
+
+// fieldElement is an element of GF(2^233): a polynomial whose coefficients are the bits of its little-endian words.
+type fieldElement [4]uint64
+
+// curvePoint is an affine point upon sect233r1.
+type curvePoint struct {
+	X, Y     fieldElement
+	Infinity bool
+}
+
+const (
+	fieldBits = 233
+
+	// fieldElementSize is the size of encoded field elements and scalars, in bytes.
+	fieldElementSize = 30
+)
+
+var (
+	// fieldPolynomial is the reduction polynomial x^233 + x^74 + 1.
+	fieldPolynomial = fieldElement{1, 1 << (74 - 64), 0, 1 << (233 - 192)}
+
+	curveA = fieldElement{1}
+	curveB = mustFieldElement("0066647ede6c332c7f8c0923bb58213b333b20e9ce4281fe115f7d8f90ad")
+
+	curveGenerator = curvePoint{
+		X: mustFieldElement("00fac9dfcbac8313bb2139f1bb755fef65bc391f8b36f8f8eb7371fd558b"),
+		Y: mustFieldElement("01006a08a41903350678e58528bebf8a0beff867a7ca36716f7e01f81052"),
+	}
+	curveOrder, _ = new(big.Int).SetString("1000000000000000000000000000013e974e72f8a6922031d2603cfe0d7", 16)
+)
+
+func mustFieldElement(hexadecimal string) fieldElement {
+	value, _ := new(big.Int).SetString(hexadecimal, 16)
+	element, err := fieldElementFromBytes(value.FillBytes(make([]byte, fieldElementSize)))
+	if err != nil {
+		panic(err)
+	}
+	return element
+}
+
+// fieldElementFromBytes decodes a big-endian field element.
+func fieldElementFromBytes(encoded []byte) (fieldElement, error) {
+	var element fieldElement
+	if len(encoded) != fieldElementSize {
+		return element, errors.New("field element is of the wrong size")
+	}
+
+	for i, b := range encoded {
+		bit := (len(encoded) - 1 - i) * 8
+		element[bit/64] |= uint64(b) << (bit % 64)
+	}
+	if element.degree() >= fieldBits {
+		return element, errors.New("field element is too large")
+	}
+	return element, nil
+}
+
+// bytes encodes a field element as big-endian.
+func (a fieldElement) bytes() []byte {
+	encoded := make([]byte, fieldElementSize)
+	for i := range encoded {
+		bit := (len(encoded) - 1 - i) * 8
+		encoded[i] = byte(a[bit/64] >> (bit % 64))
+	}
+	return encoded
+}
+
+// degree returns the index of the highest set coefficient, or -1 for zero.
+func (a fieldElement) degree() int {
+	for i := len(a) - 1; i >= 0; i-- {
+		if a[i] != 0 {
+			return i*64 + bits.Len64(a[i]) - 1
+		}
+	}
+	return -1
+}
+
+func (a fieldElement) add(b fieldElement) fieldElement {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
+
+func (a fieldElement) shiftRight() fieldElement {
+	for i := 0; i < len(a)-1; i++ {
+		a[i] = a[i]>>1 | a[i+1]<<63
+	}
+	a[len(a)-1] >>= 1
+	return a
+}
+
+func (a fieldElement) mul(b fieldElement) fieldElement {
+	var product [8]uint64
+	for i := range b {
+		for shift := 0; shift < 64; shift++ {
+			if b[i]>>shift&1 == 0 {
+				continue
+			}
+			for j := range a {
+				product[i+j] ^= a[j] << shift
+				if shift != 0 {
+					product[i+j+1] ^= a[j] >> (64 - shift)
+				}
+			}
+		}
+	}
+
+	// As x^233 = x^74 + 1, each coefficient beyond the field folds into two below it.
+	for bit := 2*fieldBits - 2; bit >= fieldBits; bit-- {
+		if product[bit/64]>>(bit%64)&1 == 0 {
+			continue
+		}
+		product[bit/64] ^= 1 << (bit % 64)
+		low := bit - fieldBits
+		product[low/64] ^= 1 << (low % 64)
+		middle := low + 74
+		product[middle/64] ^= 1 << (middle % 64)
+	}
+
+	return fieldElement{product[0], product[1], product[2], product[3]}
+}
+
+// inverse returns the multiplicative inverse of a non-zero element, via the binary extended Euclidean algorithm.
+func (a fieldElement) inverse() fieldElement {
+	if a == (fieldElement{}) {
+		panic("inverse of zero")
+	}
+
+	one := fieldElement{1}
+	u, v := a, fieldPolynomial
+	g1, g2 := one, fieldElement{}
+	for u != one && v != one {
+		for u[0]&1 == 0 {
+			u = u.shiftRight()
+			if g1[0]&1 != 0 {
+				g1 = g1.add(fieldPolynomial)
+			}
+			g1 = g1.shiftRight()
+		}
+		for v[0]&1 == 0 {
+			v = v.shiftRight()
+			if g2[0]&1 != 0 {
+				g2 = g2.add(fieldPolynomial)
+			}
+			g2 = g2.shiftRight()
+		}
+
+		if u.degree() > v.degree() {
+			u, g1 = u.add(v), g1.add(g2)
+		} else {
+			v, g2 = v.add(u), g2.add(g1)
+		}
+	}
+
+	if u == one {
+		return g1
+	}
+	return g2
+}
+
+// onCurve determines whether a point satisfies y^2 + xy = x^3 + ax^2 + b.
+func (p curvePoint) onCurve() bool {
+	if p.Infinity {
+		return false
+	}
+
+	xx := p.X.mul(p.X)
+	left := p.Y.mul(p.Y).add(p.X.mul(p.Y))
+	right := xx.mul(p.X).add(curveA.mul(xx)).add(curveB)
+	return left == right
+}
+
+func (p curvePoint) add(q curvePoint) curvePoint {
+	switch {
+	case p.Infinity:
+		return q
+	case q.Infinity:
+		return p
+	case p.X == q.X:
+		if p.Y == q.Y {
+			return p.double()
+		}
+		// Otherwise, q is the negation of p.
+		return curvePoint{Infinity: true}
+	}
+
+	lambda := p.Y.add(q.Y).mul(p.X.add(q.X).inverse())
+	x := lambda.mul(lambda).add(lambda).add(p.X).add(q.X).add(curveA)
+	y := lambda.mul(p.X.add(x)).add(x).add(p.Y)
+	return curvePoint{X: x, Y: y}
+}
+
+func (p curvePoint) double() curvePoint {
+	if p.Infinity || p.X == (fieldElement{}) {
+		return curvePoint{Infinity: true}
+	}
+
+	lambda := p.X.add(p.Y.mul(p.X.inverse()))
+	x := lambda.mul(lambda).add(lambda).add(curveA)
+	y := p.X.mul(p.X).add(lambda.add(fieldElement{1}).mul(x))
+	return curvePoint{X: x, Y: y}
+}
+
+// scalarMult returns k·p. As only public values are multiplied, it need not run in constant time.
+func (p curvePoint) scalarMult(k *big.Int) curvePoint {
+	result := curvePoint{Infinity: true}
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		result = result.double()
+		if k.Bit(i) == 1 {
+			result = result.add(p)
+		}
+	}
+	return result
+}
+
+// parseECCPublicKey decodes a public key as the Wii stores it, the X and Y coordinates concatenated.
+func parseECCPublicKey(encoded []byte) (curvePoint, error) {
+	if len(encoded) != 2*fieldElementSize {
+		return curvePoint{}, errors.New("public key must be 60 bytes")
+	}
+
+	x, err := fieldElementFromBytes(encoded[:fieldElementSize])
+	if err != nil {
+		return curvePoint{}, err
+	}
+	y, err := fieldElementFromBytes(encoded[fieldElementSize:])
+	if err != nil {
+		return curvePoint{}, err
+	}
+
+	key := curvePoint{X: x, Y: y}
+	if !key.onCurve() {
+		return curvePoint{}, errors.New("public key is not a point upon sect233r1")
+	}
+	return key, nil
+}
+
+// verifyECDSA checks a signature of hash by key, given as the concatenation of r and s.
+// Hashes must not be longer than the curve's order, as is the case for the SHA-1 hashes the Wii signs.
+func verifyECDSA(key curvePoint, hash []byte, signature []byte) bool {
+	if len(signature) != 2*fieldElementSize {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:fieldElementSize])
+	s := new(big.Int).SetBytes(signature[fieldElementSize:])
+	if r.Sign() <= 0 || r.Cmp(curveOrder) >= 0 || s.Sign() <= 0 || s.Cmp(curveOrder) >= 0 {
+		return false
+	}
+
+	w := new(big.Int).ModInverse(s, curveOrder)
+	u1 := new(big.Int).SetBytes(hash)
+	u1.Mul(u1, w).Mod(u1, curveOrder)
+	u2 := new(big.Int).Mul(r, w)
+	u2.Mod(u2, curveOrder)
+
+	point := curveGenerator.scalarMult(u1).add(key.scalarMult(u2))
+	if point.Infinity {
+		return false
+	}
+
+	v := new(big.Int).SetBytes(point.X.bytes())
+	return v.Mod(v, curveOrder).Cmp(r) == 0
+}
@@ -22,20 +22,24 @@ import (
 )
 
 const (
-	QueryOwnedTitles = `SELECT o.ticket_id, o.title_id, s.version, o.revocation_date
+	// revocation_date is a nullable timestamp, whereas consoles expect milliseconds since the epoch,
+	// or 0 for tickets which are not revoked. Scanning the timestamp itself into an integer would fail.
+	QueryOwnedTitles = `SELECT o.ticket_id, o.title_id, s.version, COALESCE(EXTRACT(EPOCH FROM o.revocation_date)::bigint * 1000, 0)
 		FROM owned_titles o
 		JOIN shop_titles s on s.title_id = o.title_id
 		AND o.account_id = $1`
 )
 
 func checkDeviceStatus(e *Envelope) {
-	e.AddCustomType(Balance{
-		Amount:   2147483647,
-		Currency: "POINTS",
+	e.Respond(&CheckDeviceStatusResponse{
+		Balance: Balance{
+			Amount:   2147483647,
+			Currency: "POINTS",
+		},
+		ForceSyncTime: "0",
+		ExtTicketTime: e.Timestamp(),
+		SyncTime:      e.Timestamp(),
 	})
-	e.AddKVNode("ForceSyncTime", "0")
-	e.AddKVNode("ExtTicketTime", e.Timestamp())
-	e.AddKVNode("SyncTime", e.Timestamp())
 }
 
 func notifyETicketsSynced(e *Envelope) {
@@ -49,7 +53,7 @@ func listETickets(e *Envelope) {
 		return
 	}
 
-	rows, err := pool.Query(ctx, QueryOwnedTitles, accountId)
+	rows, err := db.Query(ctx, QueryOwnedTitles, accountId)
 	if err != nil {
 		e.Error(2, "that's all you've got for me? ;3", err)
 		return
@@ -57,6 +61,7 @@ func listETickets(e *Envelope) {
 
 	// Add all available titles for this account.
 	defer rows.Close()
+	var tickets []Tickets
 	for rows.Next() {
 		var ticketId string
 		var titleId string
@@ -68,7 +73,7 @@ func listETickets(e *Envelope) {
 			return
 		}
 
-		e.AddCustomType(Tickets{
+		tickets = append(tickets, Tickets{
 			TicketId:   ticketId,
 			TitleId:    titleId,
 			Version:    version,
@@ -80,64 +85,77 @@ func listETickets(e *Envelope) {
 		})
 	}
 
-	e.AddKVNode("ForceSyncTime", "0")
-	e.AddKVNode("ExtTicketTime", e.Timestamp())
-	e.AddKVNode("SyncTime", e.Timestamp())
+	e.Respond(&ListETicketsResponse{
+		Tickets:       tickets,
+		ForceSyncTime: "0",
+		ExtTicketTime: e.Timestamp(),
+		SyncTime:      e.Timestamp(),
+	})
 }
 
 func getETickets(e *Envelope) {
-	e.AddKVNode("ForceSyncTime", "0")
-	e.AddKVNode("ExtTicketTime", e.Timestamp())
-	e.AddKVNode("SyncTime", e.Timestamp())
+	e.Respond(&GetETicketsResponse{
+		ForceSyncTime: "0",
+		ExtTicketTime: e.Timestamp(),
+		SyncTime:      e.Timestamp(),
+	})
 }
 
 func purchaseTitle(e *Envelope) {
-	e.AddCustomType(Balance{
-		Amount:   2018,
-		Currency: "POINTS",
-	})
-	e.AddCustomType(Transactions{
-		TransactionId: "00000000",
-		Date:          e.Timestamp(),
-		Type:          "PURCHGAME",
+	purchasesTotal.Inc()
+	e.Respond(&PurchaseTitleResponse{
+		Balance: Balance{
+			Amount:   2018,
+			Currency: "POINTS",
+		},
+		Transactions: Transactions{
+			TransactionId: "00000000",
+			Date:          e.Timestamp(),
+			Type:          "PURCHGAME",
+		},
+		SyncTime: e.Timestamp(),
+		Certs:    "00000000",
+		TitleId:  "00000000",
+		ETickets: "00000000",
 	})
-	e.AddKVNode("SyncTime", e.Timestamp())
-	e.AddKVNode("Certs", "00000000")
-	e.AddKVNode("TitleId", "00000000")
-	e.AddKVNode("ETickets", "00000000")
 }
 
 func listPurchaseHistory(e *Envelope) {
-	e.AddCustomType(Transactions{
-		TransactionId: "12345678",
-		Date:          e.Timestamp(),
-		Type:          "SERVICE",
-		TotalPaid:     "7",
-		Currency:      "POINTS",
-		ItemId:        "17",
-		ItemPricing:   "7",
-		Limits:        LimitStruct(DR),
+	e.Respond(&ListPurchaseHistoryResponse{
+		Transactions: []Transactions{
+			{
+				TransactionId: "12345678",
+				Date:          e.Timestamp(),
+				Type:          "SERVICE",
+				TotalPaid:     "7",
+				Currency:      "POINTS",
+				ItemId:        "17",
+				ItemPricing:   "7",
+				Limits:        LimitStruct(DR),
+			},
+		},
+		ListResultTotalSize: 1,
 	})
-
-	e.AddKVNode("ListResultTotalSize", "1")
 }
 
-// genServiceUrl returns a URL with the given service against a configured URL.
-// Given a baseUrl of example.com and genServiceUrl("ias", "IdentityAuthenticationSOAP"),
-// it would return http://ias.example.com/ias/services/ias/IdentityAuthenticationSOAP.
-func genServiceUrl(service string, path string) string {
+// genServiceUrl returns a URL with the given service against a base URL.
+// Given a base URL of example.com and genServiceUrl("example.com", "ias", "IdentityAuthenticationSOAP"),
+// it would return http://ias.example.com/ias/services/IdentityAuthenticationSOAP.
+func genServiceUrl(baseUrl string, service string, path string) string {
 	return fmt.Sprintf("http://%s.%s/%s/services/%s", service, baseUrl, service, path)
 }
 
 func getECConfig(e *Envelope) {
-	contentUrl := fmt.Sprintf("http://ccs.%s/ccs/download", baseUrl)
-	e.AddKVNode("ContentPrefixURL", contentUrl)
-	e.AddKVNode("UncachedContentPrefixURL", contentUrl)
-	e.AddKVNode("SystemContentPrefixURL", contentUrl)
-	e.AddKVNode("SystemUncachedContentPrefixURL", contentUrl)
-
-	e.AddKVNode("EcsURL", genServiceUrl("ecs", "ECommerceSOAP"))
-	e.AddKVNode("IasURL", genServiceUrl("ias", "IdentityAuthenticationSOAP"))
-	e.AddKVNode("CasURL", genServiceUrl("cas", "CatalogingSOAP"))
-	e.AddKVNode("NusURL", genServiceUrl("nus", "NetUpdateSOAP"))
+	urls := settings().ServiceURLs(e.Region(), e.Country())
+	e.Respond(&GetECConfigResponse{
+		ContentPrefixURL:               urls.ContentPrefixURL,
+		UncachedContentPrefixURL:       urls.UncachedContentPrefixURL,
+		SystemContentPrefixURL:         urls.SystemContentPrefixURL,
+		SystemUncachedContentPrefixURL: urls.SystemUncachedContentPrefixURL,
+
+		EcsURL: urls.EcsURL,
+		IasURL: urls.IasURL,
+		CasURL: urls.CasURL,
+		NusURL: urls.NusURL,
+	})
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/antchfx/xmlquery"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addConformanceSeeds adds every conformance request to the corpus alongside its SOAPAction.
+func addConformanceSeeds(f *testing.F) {
+	for _, c := range conformanceCases {
+		name := c.Name
+		if name == "" {
+			name = c.Action
+		}
+
+		body, err := os.ReadFile(filepath.Join("testdata", "conformance", c.Service, name+".request.xml"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add("urn:"+c.Service+".wsapi.broadon.com/"+c.Action, body)
+	}
+}
+
+// isWellFormed determines whether the given document parses as XML in its entirety.
+func isWellFormed(document []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			return false
+		}
+	}
+}
+
+func FuzzParseAction(f *testing.F) {
+	f.Add("urn:ecs.wsapi.broadon.com/CheckDeviceStatus")
+	f.Add("urn:ias.wsapi.broadon.com/")
+	f.Add("urn:.wsapi.broadon.com/Register")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		service, action := parseAction(header)
+		if service == "" {
+			return
+		}
+
+		if rebuilt := "urn:" + service + ".wsapi.broadon.com/" + action; rebuilt != header {
+			t.Errorf("parsed %q as service %q and action %q", header, service, action)
+		}
+	})
+}
+
+func FuzzNormalise(f *testing.F) {
+	addConformanceSeeds(f)
+
+	f.Fuzz(func(t *testing.T, header string, body []byte) {
+		service, action := parseAction(header)
+		doc, err := normalise(service, action, bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		if doc.Data != action {
+			t.Errorf("normalised to %q, expected %q", doc.Data, action)
+		}
+	})
+}
+
+func FuzzStripNamespace(f *testing.F) {
+	f.Add([]byte(`<ecs:A xmlns:ecs="urn:ecs.wsapi.broadon.com"><ecs:B>1</ecs:B><C/></ecs:A>`))
+	f.Add([]byte(`<a:b xmlns:a="x"><!-- a:c --><a:d a:e="f"/></a:b>`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		doc, err := xmlquery.Parse(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		stripNamespace(doc)
+		for _, node := range xmlquery.Find(doc, "//*") {
+			if node.Prefix != "" {
+				t.Errorf("element %q retained prefix %q", node.Data, node.Prefix)
+			}
+		}
+	})
+}
+
+func FuzzGetKey(f *testing.F) {
+	f.Add([]byte(`<A><Version>2.0</Version><DeviceId>1</DeviceId></A>`), "Version")
+	f.Add([]byte(`<A><B><DeviceToken>WT-</DeviceToken></B></A>`), "DeviceToken")
+	f.Add([]byte(`<A/>`), "[")
+
+	f.Fuzz(func(t *testing.T, body []byte, key string) {
+		doc, err := xmlquery.Parse(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		getKey(doc, key)
+	})
+}
+
+func FuzzObtainCommon(f *testing.F) {
+	addConformanceSeeds(f)
+
+	f.Fuzz(func(t *testing.T, header string, body []byte) {
+		doc, err := xmlquery.Parse(bytes.NewReader(body))
+		if err != nil {
+			return
+		}
+
+		e := Envelope{doc: doc}
+		err = e.ObtainCommon()
+		if err != nil {
+			return
+		}
+
+		// All accessors must be usable once common values are obtained.
+		e.DeviceId()
+		e.Region()
+		e.Country()
+		e.Language()
+		e.AccountId()
+	})
+}
+
+func FuzzHandle(f *testing.F) {
+	addConformanceSeeds(f)
+	f.Add("urn:nus.wsapi.broadon.com/GetSystemUpdate", []byte(`<soapenv:Envelope/>`))
+	f.Add("", []byte(nil))
+
+	setupTestServer(f)
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	f.Fuzz(func(t *testing.T, header string, body []byte) {
+		db = newTestDatabase()
+		verifiedTokens = newAuthCache()
+		limiter = newRateLimiter()
+
+		request := httptest.NewRequest("POST", "/ecs/services/ECommerceSOAP", bytes.NewReader(body))
+		request.Header.Set("SOAPAction", header)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		switch recorder.Code {
+		case http.StatusOK, http.StatusUnauthorized, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusInternalServerError:
+		default:
+			t.Fatalf("unexpected status %d", recorder.Code)
+		}
+
+		if strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/xml") && !isWellFormed(recorder.Body.Bytes()) {
+			t.Fatalf("response is not well-formed:\n%s", recorder.Body.String())
+		}
+	})
+}
@@ -1,11 +1,35 @@
 module github.com/OpenShopChannel/WiiSOAP
 
-go 1.16
+go 1.21
 
 require (
 	github.com/RiiConnect24/wiino v0.0.0-20210419165641-a2614cecbcca
 	github.com/antchfx/xmlquery v1.3.6
 	github.com/jackc/pgconn v1.8.1
+	github.com/jackc/pgproto3/v2 v2.0.6
 	github.com/jackc/pgx/v4 v4.11.0
-	github.com/logrusorgru/aurora/v3 v3.0.0
+	github.com/prometheus/client_golang v1.11.0
+)
+
+require (
+	github.com/antchfx/xpath v1.1.10 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
+	github.com/jackc/pgio v1.0.0 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	github.com/jackc/pgtype v1.7.0 // indirect
+	github.com/jackc/puddle v1.1.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110 // indirect
+	golang.org/x/sys v0.0.0-20210603081109-ebe580a85c40 // indirect
+	golang.org/x/text v0.3.3 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
 )
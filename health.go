@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// SchemaVersion is the version of database.sql this release expects.
+	// It must be incremented alongside any change to the schema.
+	SchemaVersion = 9
+
+	QuerySchemaVersion = `SELECT version FROM schema_version`
+
+	// readinessTimeout limits how long all readiness checks may take.
+	readinessTimeout = 5 * time.Second
+)
+
+// readinessCheck determines whether a dependency necessary to serve requests is available.
+type readinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// readinessChecks are run for every readiness request, in order.
+var readinessChecks = []readinessCheck{
+	{"database", checkDatabase},
+	{"migrations", checkMigrations},
+	{"signing_keys", checkSigningKeys},
+}
+
+// CheckStatus represents the outcome of an individual check.
+type CheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthStatus represents the response to a health or readiness request.
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckStatus `json:"checks,omitempty"`
+}
+
+// checkDatabase ensures PostgreSQL is reachable.
+func checkDatabase(ctx context.Context) error {
+	return db.Ping(ctx)
+}
+
+// checkMigrations ensures the database's schema matches what we expect.
+func checkMigrations(ctx context.Context) error {
+	var version int
+	err := db.QueryRow(ctx, QuerySchemaVersion).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version != SchemaVersion {
+		return fmt.Errorf("database schema is at version %d, expected %d", version, SchemaVersion)
+	}
+
+	return nil
+}
+
+// checkSigningKeys ensures the configured MS public key, if any, is able to verify device certificates.
+func checkSigningKeys(_ context.Context) error {
+	_, _, err := settings().DeviceCertificates.publicKey()
+	if err != nil {
+		return fmt.Errorf("MS public key is invalid: %w", err)
+	}
+
+	return nil
+}
+
+// healthHandler reports that the process is alive and able to serve HTTP.
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// readinessHandler reports whether all dependencies are available to serve requests.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checkCtx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	status := HealthStatus{
+		Status: "ok",
+		Checks: map[string]CheckStatus{},
+	}
+	for _, check := range readinessChecks {
+		err := check.Check(checkCtx)
+		if err != nil {
+			status.Status = "unavailable"
+			status.Checks[check.Name] = CheckStatus{Status: "error", Error: err.Error()}
+			logger.Warn("readiness check failed", "check", check.Name, "err", err)
+		} else {
+			status.Checks[check.Name] = CheckStatus{Status: "ok"}
+		}
+	}
+
+	if status.Status == "ok" {
+		writeHealth(w, http.StatusOK, status)
+	} else {
+		writeHealth(w, http.StatusServiceUnavailable, status)
+	}
+}
+
+func writeHealth(w http.ResponseWriter, statusCode int, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(status)
+}
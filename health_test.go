@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	setupTestServer(t)
+
+	cases := []struct {
+		Name        string
+		MSPublicKey string
+		Status      int
+		Check       string
+	}{
+		{"unverified", "", http.StatusOK, "ok"},
+		{"verified", testMSPublicKey(), http.StatusOK, "ok"},
+		{"invalid key", testMSPublicKey()[:len(testMSPublicKey())-2] + "00", http.StatusServiceUnavailable, "error"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			config := *settings()
+			config.DeviceCertificates.MSPublicKey = c.MSPublicKey
+			previous := currentConfig.Swap(&config)
+			defer currentConfig.Store(previous)
+
+			recorder := httptest.NewRecorder()
+			readinessHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			if recorder.Code != c.Status {
+				t.Errorf("status %d, expected %d", recorder.Code, c.Status)
+			}
+
+			var status HealthStatus
+			err := json.Unmarshal(recorder.Body.Bytes(), &status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if check := status.Checks["signing_keys"]; check.Status != c.Check {
+				t.Errorf("signing_keys check is %+v, expected %s", check, c.Check)
+			}
+		})
+	}
+}
@@ -23,16 +23,62 @@ import (
 	"fmt"
 	wiino "github.com/RiiConnect24/wiino/golang"
 	"github.com/jackc/pgconn"
-	"log"
-	"math/rand"
+	"github.com/jackc/pgx/v4"
 	"strconv"
+	"time"
 )
 
 const (
-	PrepareUserStatement = `INSERT INTO userbase (device_id, device_token, device_token_hashed, account_id, region, country, language, serial_number, device_code)  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	SyncUserStatement    = `SELECT account_id, device_code, device_token FROM userbase WHERE language = $1 AND country = $2 AND region = $3 AND device_id = $4`
+	PrepareUserStatement = `INSERT INTO userbase (device_id, device_token_hashed, account_id, region, country, language, serial_number, device_code, device_token_issued, device_cert, device_cert_verified)  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	SyncUserStatement    = `SELECT account_id, device_token_issued, CASE WHEN device_cert_verified THEN device_cert END FROM userbase WHERE language = $1 AND country = $2 AND region = $3 AND device_id = $4 ORDER BY device_token_issued DESC LIMIT 1`
+	UpdateTokenStatement = `UPDATE userbase SET device_token_hashed = $1, device_token_issued = $2 WHERE account_id = $3`
+	// SyncAccountStatement looks up the account a console has authenticated as, regardless of its locale.
+	SyncAccountStatement = `SELECT device_token_issued FROM userbase WHERE account_id = $1 AND device_id = $2`
+
+	// A console registers again with a new device code after its NAND is formatted, so several accounts may share
+	// its device ID. Statements by device ID consider the account most recently issued a token.
+	CheckRegistrationStatement = `SELECT COALESCE(serial_number, '') FROM userbase WHERE device_id = $1 ORDER BY device_token_issued DESC LIMIT 1`
+)
+
+// Registration statuses reported by CheckRegistration. Consoles are transferred
+// if registered with another serial number, such as after their NAND was restored onto another.
+const (
+	DeviceStatusUnregistered = "U"
+	DeviceStatusRegistered   = "R"
+	DeviceStatusTransferred  = "T"
+	DeviceStatusBanned       = "B"
 )
 
+// registrationAttempts limits how many account IDs and tokens are generated
+// before giving up on finding ones not already in use.
+const registrationAttempts = 5
+
+// isRegenerableConflict determines whether err violates a unique index
+// on a value we randomly generate, so that generating another may succeed.
+func isRegenerableConflict(err error) bool {
+	driverErr, ok := err.(*pgconn.PgError)
+	if !ok || driverErr.Code != "23505" {
+		return false
+	}
+
+	switch driverErr.ConstraintName {
+	case "userbase_pk", "userbase_account_id_uindex", "userbase_device_token_hashed_uindex":
+		return true
+	}
+	return false
+}
+
+// issueDeviceToken generates a device token, returning it alongside its md5,
+// because the Wii sends the md5 for most requests. Only the md5 is stored.
+func issueDeviceToken() (string, string, error) {
+	deviceToken, err := RandString(21)
+	if err != nil {
+		return "", "", err
+	}
+
+	return deviceToken, fmt.Sprintf("%x", md5.Sum([]byte(deviceToken))), nil
+}
+
 func checkRegistration(e *Envelope) {
 	serialNo, err := getKey(e.doc, "SerialNumber")
 	if err != nil {
@@ -40,45 +86,169 @@ func checkRegistration(e *Envelope) {
 		return
 	}
 
-	e.AddKVNode("OriginalSerialNumber", serialNo)
-	e.AddKVNode("DeviceStatus", "R")
+	// The router only checks bans for authenticated actions, so those of the identifiers presented are checked here.
+	// Only whether the console is banned is disclosed, not why.
+	ban, err := findBan(ctx, e.DeviceId(), "", serialNo, "")
+	if err != nil {
+		e.Error(5, "An error occurred querying the database.", err)
+		return
+	} else if ban != nil {
+		e.Respond(&CheckRegistrationResponse{
+			OriginalSerialNumber: serialNo,
+			DeviceStatus:         DeviceStatusBanned,
+		})
+		return
+	}
+
+	var storedSerialNo string
+	err = db.QueryRow(ctx, CheckRegistrationStatement, e.DeviceId()).Scan(&storedSerialNo)
+	if err == pgx.ErrNoRows {
+		// First-time consoles must register.
+		e.Respond(&CheckRegistrationResponse{
+			OriginalSerialNumber: serialNo,
+			DeviceStatus:         DeviceStatusUnregistered,
+		})
+		return
+	} else if err != nil {
+		e.Error(5, "An error occurred querying the database.", err)
+		return
+	}
+
+	status := DeviceStatusRegistered
+	if storedSerialNo == "" {
+		storedSerialNo = serialNo
+	} else if storedSerialNo != serialNo {
+		status = DeviceStatusTransferred
+	}
+
+	e.Respond(&CheckRegistrationResponse{
+		OriginalSerialNumber: storedSerialNo,
+		DeviceStatus:         status,
+	})
 }
 
 func getChallenge(e *Envelope) {
 	// The official Wii Shop Channel requests a Challenge from the server, and promptly disregards it.
 	// (Sometimes, it may not request a challenge at all.) No attempt is made to validate the response.
 	// It then uses another hard-coded value in place of this returned value entirely in any situation.
-	// For this reason, we consider it irrelevant.
-	e.AddKVNode("Challenge", SharedChallenge)
+	// For this reason, we only issue and verify challenges in strict mode, for clients which return them.
+	challenge, err := issueChallenge(e)
+	if err != nil {
+		e.Error(7, "An error occurred issuing a challenge.", err)
+		return
+	}
+
+	e.Respond(&GetChallengeResponse{
+		Challenge: challenge,
+	})
 }
 
 func getRegistrationInfo(e *Envelope) {
 	// GetRegistrationInfo is SyncRegistration with authentication and an additional key.
-	syncRegistration(e)
+	// As the console has proven it holds its token, it may be issued another for the account it authenticated as.
+	// Other accounts may share its device ID, so its locale must not select which.
+	accountId, err := e.AccountId()
+	if err != nil {
+		e.Error(7, "An error occurred querying the database.", err)
+		return
+	}
+	var issued time.Time
+	err = db.QueryRow(ctx, SyncAccountStatement, accountId, e.DeviceId()).Scan(&issued)
+	if err != nil {
+		e.Error(7, "An error occurred querying the database.", err)
+		return
+	}
+
+	sync, ok := syncRegistrationResponse(e, accountId, issued, true)
+	if !ok {
+		return
+	}
+
+	e.Respond(&GetRegistrationInfoResponse{
+		SyncRegistrationResponse: *sync,
 
-	// This _must_ be POINTS.
-	// It does not appear to be observed by any known client,
-	// but is sent by Nintendo in official requests.
-	e.AddKVNode("Currency", "POINTS")
+		// This _must_ be POINTS.
+		// It does not appear to be observed by any known client,
+		// but is sent by Nintendo in official requests.
+		Currency: "POINTS",
+	})
 }
 
 func syncRegistration(e *Envelope) {
+	// Signatures are verified against the certificate of the very account a token would be issued for,
+	// so that registering another account with this device ID cannot obtain this one's token.
 	var accountId int64
-	var deviceCode int
-	var deviceToken string
+	var issued time.Time
+	var deviceCert []byte
+	user := db.QueryRow(ctx, SyncUserStatement, e.Language(), e.Country(), e.Region(), e.DeviceId())
+	err := user.Scan(&accountId, &issued, &deviceCert)
+	if err != nil {
+		e.Error(7, "An error occurred querying the database.", err)
+		return
+	}
 
-	user := pool.QueryRow(ctx, SyncUserStatement, e.Language(), e.Country(), e.Region(), e.DeviceId())
-	err := user.Scan(&accountId, &deviceCode, &deviceToken)
+	signed, err := verifyChallenge(e, deviceCert)
 	if err != nil {
+		e.Error(InvalidChallengeErrorCode, "Your console did not return a valid challenge.", err)
+		return
+	}
+
+	// Consoles proving their identity are told of bans applying to them before being issued a token.
+	if signed {
+		ban, err := findBan(ctx, e.DeviceId(), "", "", "")
+		if err != nil {
+			e.Error(7, "An error occurred querying the database.", err)
+			return
+		} else if ban != nil {
+			refuseBanned(e, "ias", ban, true)
+			return
+		}
+	}
+
+	// Any client may claim to be any console here, so tokens are only issued to those signing their challenge
+	// with the key of the certificate they registered with. Others must authenticate via GetRegistrationInfo.
+	sync, ok := syncRegistrationResponse(e, accountId, issued, signed)
+	if !ok {
+		return
+	}
+
+	e.Respond(sync)
+}
+
+// syncRegistrationResponse describes the given account of the requesting console, whose token was issued
+// at the given time, replacing its device token with one returned if issueToken is set.
+// On failure, it sets the envelope's error and returns false.
+func syncRegistrationResponse(e *Envelope, accountId int64, issued time.Time, issueToken bool) (*SyncRegistrationResponse, bool) {
+	sync := &SyncRegistrationResponse{
+		AccountId:    accountId,
+		Country:      e.Country(),
+		ExtAccountId: "",
+		DeviceStatus: DeviceStatusRegistered,
+	}
+	if !issueToken {
+		// Consoles are informed when the token they hold has expired.
+		sync.DeviceTokenExpired = tokenExpired(issued)
+		return sync, true
+	}
+
+	// We only retain the hash of the previous token, so issue a new one in its place.
+	deviceToken, md5DeviceToken, err := issueDeviceToken()
+	if err != nil {
+		e.Error(7, "An error occurred generating a device token.", err)
+		return nil, false
+	}
+
+	_, err = db.Exec(ctx, UpdateTokenStatement, md5DeviceToken, now().UTC(), accountId)
+	if err != nil {
+		e.logger.Error("error executing statement", "err", err)
 		e.Error(7, "An error occurred querying the database.", err)
+		return nil, false
 	}
+	verifiedTokens.Invalidate(e.DeviceId())
 
-	e.AddKVNode("AccountId", strconv.FormatInt(accountId, 10))
-	e.AddKVNode("DeviceToken", deviceToken)
-	e.AddKVNode("DeviceTokenExpired", "false")
-	e.AddKVNode("Country", e.Country())
-	e.AddKVNode("ExtAccountId", "")
-	e.AddKVNode("DeviceStatus", "R")
+	// The token returned is fresh, regardless of whether the one it replaces had expired.
+	sync.DeviceToken = deviceToken
+	return sync, true
 }
 
 func register(e *Envelope) {
@@ -105,6 +275,20 @@ func register(e *Envelope) {
 		return
 	}
 
+	// Reject registrations no real console could have made.
+	if err = validateSerialNumber(serialNo); err != nil {
+		e.Error(InvalidSerialNumberErrorCode, "Your console's serial number is invalid.", err)
+		return
+	}
+	if err = validateDeviceId(e.DeviceId()); err != nil {
+		e.Error(InvalidDeviceIdErrorCode, "Your console's device ID is invalid.", err)
+		return
+	}
+	if err = validateLocale(e.Region(), e.Country(), e.Language()); err != nil {
+		e.Error(InvalidLocaleErrorCode, "Your console's country or language is not available to its region.", err)
+		return
+	}
+
 	// Validate given friend code.
 	userId, err := strconv.ParseUint(deviceCode, 10, 64)
 	if err != nil {
@@ -112,21 +296,71 @@ func register(e *Envelope) {
 		return
 	}
 	if wiino.NWC24CheckUserID(userId) != 0 {
-		e.Error(7, reason, err)
+		e.Error(7, reason, errors.New("invalid device code"))
 		return
 	}
 
-	// Generate a random 9-digit number, padding zeros as necessary.
-	accountId := rand.Int63n(999999999)
+	deviceCert, certVerified, err := registrationCertificate(e)
+	if err != nil {
+		e.Error(InvalidDeviceCertificateErrorCode, "Your console's certificate is invalid.", err)
+		return
+	}
 
-	// Generate a device token, 21 characters...
-	deviceToken := RandString(21)
-	// ...and then its md5, because the Wii sends this for most requests.
-	md5DeviceToken := fmt.Sprintf("%x", md5.Sum([]byte(deviceToken)))
+	// Signatures can only be verified against certificates the MS is known to have issued.
+	var verifiedCert []byte
+	if certVerified {
+		verifiedCert = deviceCert
+	}
+	if _, err = verifyChallenge(e, verifiedCert); err != nil {
+		e.Error(InvalidChallengeErrorCode, "Your console did not return a valid challenge.", err)
+		return
+	}
 
-	// Insert all of our obtained values to the database..
-	_, err = pool.Exec(ctx, PrepareUserStatement, e.DeviceId(), deviceToken, md5DeviceToken, accountId, e.Region(), e.Country(), e.Language(), serialNo, deviceCode)
+	// The router only knows of identifiers registered to this device, not those it now presents.
+	ban, err := findBan(ctx, e.DeviceId(), "", serialNo, strconv.FormatUint(userId, 10))
 	if err != nil {
+		e.logger.Error("error querying bans", "err", err)
+		e.Error(7, reason, errors.New("failed to execute db operation"))
+		return
+	} else if ban != nil {
+		refuseBanned(e, "ias", ban, false)
+		return
+	}
+
+	// Account IDs and device tokens are random, so we may rarely need to try again upon conflict.
+	var accountId int64
+	var deviceToken string
+	for attempt := 1; ; attempt++ {
+		// Generate a random 9-digit number, padding zeros as necessary.
+		accountId, err = RandInt63n(999999999)
+		if err != nil {
+			e.Error(7, reason, err)
+			return
+		}
+
+		var md5DeviceToken string
+		deviceToken, md5DeviceToken, err = issueDeviceToken()
+		if err != nil {
+			e.Error(7, reason, err)
+			return
+		}
+
+		// Insert all of our obtained values to the database..
+		_, err = db.Exec(ctx, PrepareUserStatement, e.DeviceId(), md5DeviceToken, accountId, e.Region(), e.Country(), e.Language(), serialNo, deviceCode, now().UTC(), deviceCert, certVerified)
+		if err == nil {
+			break
+		}
+
+		if isRegenerableConflict(err) {
+			if attempt < registrationAttempts {
+				e.logger.Warn("generated account ID or token already in use, retrying", "attempt", attempt)
+				continue
+			}
+			e.logger.Error("exhausted attempts to generate an unused account ID and token", "err", err)
+			e.Error(7, reason, errors.New("failed to generate a unique account"))
+			return
+		}
+
 		// It's okay if this isn't a PostgreSQL error, as perhaps other issues have come in.
 		if driverErr, ok := err.(*pgconn.PgError); ok {
 			if driverErr.Code == "23505" {
@@ -134,22 +368,27 @@ func register(e *Envelope) {
 				return
 			}
 		}
-		log.Printf("error executing statement: %v\n", err)
+		e.logger.Error("error executing statement", "err", err)
 		e.Error(7, reason, errors.New("failed to execute db operation"))
 		return
 	}
 
-	fmt.Println("The request is valid! Responding...")
-	e.AddKVNode("AccountId", strconv.FormatInt(accountId, 10))
-	e.AddKVNode("DeviceToken", deviceToken)
-	e.AddKVNode("DeviceTokenExpired", "false")
-	e.AddKVNode("Country", e.Country())
-	// Optionally, one can send back DeviceCode and ExtAccountId to update on device.
-	// We send these back as-is regardless.
-	e.AddKVNode("ExtAccountId", "")
-	e.AddKVNode("DeviceCode", deviceCode)
+	e.logger.Info("registered console", "account_id", accountId)
+	registrationsTotal.Inc()
+	e.Respond(&RegisterResponse{
+		AccountId:          accountId,
+		DeviceToken:        deviceToken,
+		DeviceTokenExpired: false,
+		Country:            e.Country(),
+		// Optionally, one can send back DeviceCode and ExtAccountId to update on device.
+		// We send these back as-is regardless.
+		ExtAccountId: "",
+		DeviceCode:   deviceCode,
+	})
 }
 
 func unregister(e *Envelope) {
 	// how abnormal... ;3
+	// Should unregistration ever be implemented, its credentials must no longer be accepted.
+	verifiedTokens.Invalidate(e.DeviceId())
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSyncRegistrationIssuesTokens(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	strictChallenges(&config)
+	currentConfig.Store(&config)
+	route := newServiceRoute()
+	server := httptest.NewServer(route.Handle())
+	defer server.Close()
+
+	hash := sha1.Sum([]byte(testChallenge))
+	signature := base64.StdEncoding.EncodeToString(signECDSA(big.NewInt(0x0402503b), hash[:], big.NewInt(42)))
+
+	// Consoles registered without a certificate cannot sign their challenge.
+	uncertified := testCertifiedUser
+	uncertified.DeviceCert = nil
+
+	cases := []struct {
+		Name      string
+		User      memoryUser
+		Signature string
+		Issued    bool
+	}{
+		{"unsigned", uncertified, "", false},
+		{"signed", testCertifiedUser, signature, true},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			database := newTestDatabase()
+			database.users = append(database.users, c.User)
+			database.challenges = []memoryChallenge{
+				{DeviceId: testCertifiedUser.DeviceId, Challenge: testChallenge, Expires: testChallengeExpiry},
+			}
+			db = database
+			verifiedTokens = newAuthCache()
+
+			client := &Client{
+				BaseURL:  server.URL,
+				HTTP:     server.Client(),
+				DeviceId: int(testCertifiedUser.DeviceId),
+				Region:   "USA",
+				Country:  "US",
+				Language: "en",
+			}
+			sync := &SyncRegistrationResponse{}
+			err := client.Call("ias", "SyncRegistration", &SyncRegistrationRequest{Challenge: testChallenge, Signature: c.Signature}, sync)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (sync.DeviceToken != "") != c.Issued {
+				t.Fatalf("issued token %q", sync.DeviceToken)
+			}
+
+			// Whichever token the console is left with must authenticate, and only that.
+			client.AccountId = sync.AccountId
+			client.DeviceToken = testCertifiedDeviceToken
+			if c.Issued {
+				stale := *client
+				err = stale.Call("ecs", "CheckDeviceStatus", &CheckDeviceStatusRequest{}, &CheckDeviceStatusResponse{})
+				if err == nil {
+					t.Error("the replaced token was still accepted")
+				}
+				client.DeviceToken = sync.DeviceToken
+			}
+			err = client.Call("ecs", "CheckDeviceStatus", &CheckDeviceStatusRequest{}, &CheckDeviceStatusResponse{})
+			if err != nil {
+				t.Errorf("token was not accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestExpiredTokens(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	config.DeviceTokenLifetime = Duration{time.Hour}
+	currentConfig.Store(&config)
+	now = func() time.Time {
+		return testTime.Add(2 * time.Hour)
+	}
+	route := newServiceRoute()
+	server := httptest.NewServer(route.Handle())
+	defer server.Close()
+
+	client := &Client{
+		BaseURL:     server.URL,
+		HTTP:        server.Client(),
+		DeviceId:    testDeviceId,
+		Region:      "USA",
+		Country:     "US",
+		Language:    "en",
+		AccountId:   testAccountId,
+		DeviceToken: testDeviceToken,
+	}
+
+	// Consoles learn that their token expired, but are not issued another without authenticating.
+	sync := &SyncRegistrationResponse{}
+	err := client.Call("ias", "SyncRegistration", &SyncRegistrationRequest{}, sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sync.DeviceTokenExpired || sync.DeviceToken != "" {
+		t.Errorf("SyncRegistration returned token %q, expired %v", sync.DeviceToken, sync.DeviceTokenExpired)
+	}
+
+	// The token issued in its place has not.
+	info := &GetRegistrationInfoResponse{}
+	err = client.Call("ias", "GetRegistrationInfo", &GetRegistrationInfoRequest{}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DeviceTokenExpired || info.DeviceToken == "" {
+		t.Errorf("GetRegistrationInfo returned token %q, expired %v", info.DeviceToken, info.DeviceTokenExpired)
+	}
+}
+
+func TestGetRegistrationInfoAccount(t *testing.T) {
+	setupTestServer(t)
+	database := newTestDatabase()
+	database.users = append(database.users, testOtherAccount)
+	db = database
+	route := newServiceRoute()
+	server := httptest.NewServer(route.Handle())
+	defer server.Close()
+
+	// Another client, authenticated as its own account, presents the test console's locale.
+	other := &Client{
+		BaseURL:     server.URL,
+		HTTP:        server.Client(),
+		DeviceId:    testDeviceId,
+		Region:      "USA",
+		Country:     "US",
+		Language:    "en",
+		AccountId:   testOtherAccount.AccountId,
+		DeviceToken: testOtherAccountToken,
+	}
+	info := &GetRegistrationInfoResponse{}
+	err := other.Call("ias", "GetRegistrationInfo", &GetRegistrationInfoRequest{}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AccountId != testOtherAccount.AccountId {
+		t.Errorf("issued a token for account %d", info.AccountId)
+	}
+
+	// The test console's token must remain its own.
+	console := *other
+	console.AccountId = testAccountId
+	console.DeviceToken = testDeviceToken
+	err = console.Call("ecs", "CheckDeviceStatus", &CheckDeviceStatusRequest{}, &CheckDeviceStatusResponse{})
+	if err != nil {
+		t.Errorf("the test console's token was replaced: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	wiino "github.com/RiiConnect24/wiino/golang"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// actionStats aggregates the outcomes of an action across all virtual consoles.
+type actionStats struct {
+	Latencies []time.Duration
+	Errors    map[string]int
+}
+
+// loadStats aggregates outcomes per action, safe for concurrent use.
+type loadStats struct {
+	mu      sync.Mutex
+	actions map[string]*actionStats
+	flows   int
+	failed  int
+}
+
+func (s *loadStats) record(step ClientStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := step.Service + "/" + step.Action
+	stats, ok := s.actions[name]
+	if !ok {
+		stats = &actionStats{Errors: map[string]int{}}
+		s.actions[name] = stats
+	}
+
+	stats.Latencies = append(stats.Latencies, step.Duration)
+	if step.Err != nil {
+		stats.Errors[errorKind(step.Err)]++
+	}
+}
+
+func (s *loadStats) recordFlow(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flows++
+	if err != nil {
+		s.failed++
+	}
+}
+
+// errorKind summarises an error for grouping, such as "code 7" or "HTTP 401".
+func errorKind(err error) string {
+	var soapError *SOAPError
+	var httpError *HTTPError
+	switch {
+	case errors.As(err, &soapError):
+		return "code " + strconv.Itoa(soapError.ErrorCode)
+	case errors.As(err, &httpError):
+		return "HTTP " + strconv.Itoa(httpError.StatusCode)
+	default:
+		return "transport"
+	}
+}
+
+// percentile returns the latency below which the given fraction of sorted latencies fall.
+func percentile(sorted []time.Duration, fraction float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	index := int(fraction*float64(len(sorted))+0.5) - 1
+	if index < 0 {
+		index = 0
+	} else if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
+
+// newVirtualConsole returns a client identifying as a distinct console, with a valid serial number and device code.
+func newVirtualConsole(baseURL string, httpClient *http.Client, hollywoodId uint32) *Client {
+	digits := fmt.Sprintf("%08d", hollywoodId%100000000)
+	return &Client{
+		BaseURL:      baseURL,
+		HTTP:         httpClient,
+		DeviceId:     1<<32 | int(hollywoodId),
+		SerialNumber: "LU" + digits + string(serialCheckDigit(digits)),
+		DeviceCode:   strconv.FormatUint(wiino.NWC24MakeUserID(hollywoodId, 0, 1, 1), 10),
+		Region:       "USA",
+		Country:      "US",
+		Language:     "en",
+	}
+}
+
+// loadtestCommand simulates many consoles performing the shop flow concurrently, reporting statistics per action.
+func loadtestCommand(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	baseURL := flags.String("url", "http://127.0.0.1:8080", "base URL of the server")
+	consoles := flags.Int("consoles", 10, "number of virtual consoles running concurrently")
+	duration := flags.Duration("duration", 30*time.Second, "how long to generate load for")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for each request")
+	titleId := flags.String("title", "0001000148414241", "title ID to purchase")
+	firstId := flags.Uint("first-id", 0, "Hollywood ID of the first virtual console, or 0 to choose randomly")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: WiiSOAP loadtest [flags]")
+		fmt.Fprintln(flags.Output(), "Each virtual console registers, then repeatedly performs the shop flow until the duration elapses.")
+		fmt.Fprintln(flags.Output(), "All consoles share this machine's IP, so the server's rate limits should be raised or disabled.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *consoles < 1 {
+		fmt.Fprintln(os.Stderr, "At least one console is necessary.")
+		return 2
+	}
+
+	// Consoles registered by previous runs would otherwise collide.
+	if *firstId == 0 {
+		*firstId = uint(0x04000000 + rand.Int31n(0x03000000))
+	}
+
+	httpClient := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *consoles,
+		},
+	}
+	stats := &loadStats{actions: map[string]*actionStats{}}
+
+	fmt.Printf("Running %d consoles against %s for %v...\n", *consoles, *baseURL, *duration)
+	start := time.Now()
+	deadline := start.Add(*duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *consoles; i++ {
+		wg.Add(1)
+		go func(hollywoodId uint32) {
+			defer wg.Done()
+
+			client := newVirtualConsole(*baseURL, httpClient, hollywoodId)
+			for time.Now().Before(deadline) {
+				stats.recordFlow(client.ShopFlow(*titleId, stats.record))
+			}
+		}(uint32(*firstId) + uint32(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	names := make([]string, 0, len(stats.actions))
+	total := 0
+	for name, action := range stats.actions {
+		names = append(names, name)
+		total += len(action.Latencies)
+	}
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACTION\tREQUESTS\tRATE\tP50\tP90\tP99\tMAX\tERRORS")
+	for _, name := range names {
+		action := stats.actions[name]
+		sort.Slice(action.Latencies, func(i, j int) bool {
+			return action.Latencies[i] < action.Latencies[j]
+		})
+
+		errorSummary := "-"
+		if len(action.Errors) != 0 {
+			kinds := make([]string, 0, len(action.Errors))
+			for kind := range action.Errors {
+				kinds = append(kinds, kind)
+			}
+			sort.Strings(kinds)
+
+			errorSummary = ""
+			for i, kind := range kinds {
+				if i != 0 {
+					errorSummary += ", "
+				}
+				errorSummary += fmt.Sprintf("%s: %d", kind, action.Errors[kind])
+			}
+		}
+
+		fmt.Fprintf(writer, "%s\t%d\t%.1f/s\t%v\t%v\t%v\t%v\t%s\n",
+			name,
+			len(action.Latencies),
+			float64(len(action.Latencies))/elapsed.Seconds(),
+			percentile(action.Latencies, 0.50).Round(time.Microsecond),
+			percentile(action.Latencies, 0.90).Round(time.Microsecond),
+			percentile(action.Latencies, 0.99).Round(time.Microsecond),
+			percentile(action.Latencies, 1).Round(time.Microsecond),
+			errorSummary,
+		)
+	}
+	writer.Flush()
+
+	fmt.Printf("Completed %d flows (%d failed) and %d requests in %v: %.1f requests/s.\n",
+		stats.flows, stats.failed, total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	if stats.failed != 0 {
+		return 1
+	}
+	return 0
+}
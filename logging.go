@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logLevel is the minimum level logged, adjustable at runtime.
+var logLevel = new(slog.LevelVar)
+
+// logger is used for all logging. Requests should log via their envelope's logger
+// so that lines can be correlated to the console making them.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+// setupLogging configures the format and level of logs.
+// Valid formats are "text" and "json", and valid levels are "debug", "info", "warn" and "error".
+// An empty level is considered "debug" if debug is set, or "info" otherwise.
+func setupLogging(format string, level string, debug bool) error {
+	err := setLogLevel(level, debug)
+	if err != nil {
+		return err
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, options))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, options))
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	return nil
+}
+
+// setLogLevel adjusts the minimum level logged, which is safe to do while serving.
+// An empty level is considered "debug" if debug is set, or "info" otherwise.
+func setLogLevel(level string, debug bool) error {
+	if level == "" {
+		if debug {
+			level = "debug"
+		} else {
+			level = "info"
+		}
+	}
+
+	var parsed slog.Level
+	err := parsed.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	logLevel.Set(parsed)
+
+	return nil
+}
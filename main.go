@@ -19,12 +19,20 @@ package main
 
 import (
 	"context"
-	"encoding/xml"
-	"fmt"
+	"crypto/tls"
+	"flag"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
-	"io/ioutil"
-	"log"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
@@ -33,70 +41,265 @@ const (
 	SharedChallenge = "NintyWhyPls"
 )
 
-var baseUrl string
+// Database represents the subset of pgxpool.Pool used to serve requests,
+// allowing an alternative to be substituted within tests.
+type Database interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Ping(ctx context.Context) error
+}
+
 var pool *pgxpool.Pool
+var db Database
 var ctx = context.Background()
-var isDebug = false
 
 // checkError makes error handling not as ugly and inefficient.
 func checkError(err error) {
 	if err != nil {
-		log.Fatalf("WiiSOAP forgot how to drive and suddenly crashed! Reason: %v\n", err)
+		logger.Error("WiiSOAP forgot how to drive and suddenly crashed!", "err", err)
+		os.Exit(1)
 	}
 }
 
 func main() {
+	// Subcommands are handled separately from serving.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(replayCommand(os.Args[2:]))
+		case "client":
+			os.Exit(clientCommand(os.Args[2:]))
+		case "loadtest":
+			os.Exit(loadtestCommand(os.Args[2:]))
+		}
+	}
+
 	// Initial Start.
-	fmt.Println("WiiSOAP 0.2.6 Kawauso\n[i] Reading the Config...")
+	logger.Info("WiiSOAP 0.2.6 Kawauso")
+	logger.Info("reading the config...")
 
 	// Check the Config.
-	ioconfig, err := ioutil.ReadFile("./config.xml")
-	checkError(err)
-	readConfig := Config{}
-	err = xml.Unmarshal(ioconfig, &readConfig)
-	checkError(err)
+	configPath := flag.String("config", "config.xml", "path to the configuration file")
+	flag.Parse()
+	configRequired := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configRequired = true
+		}
+	})
 
-	fmt.Println("[i] Initializing core...")
-	isDebug = readConfig.Debug
+	readConfig, err := loadConfig(*configPath, configRequired)
+	if err != nil {
+		logConfigError(err)
+		os.Exit(1)
+	}
+	currentConfig.Store(&readConfig)
+
+	err = setupLogging(readConfig.LogFormat, readConfig.LogLevel, readConfig.Debug)
+	checkError(err)
+	readConfig.warn()
+	logger.Info("initializing core...")
 
 	// Start SQL.
-	dbString := fmt.Sprintf("postgres://%s:%s@%s/%s", readConfig.SQLUser, readConfig.SQLPass, readConfig.SQLAddress, readConfig.SQLDB)
-	dbConf, err := pgxpool.ParseConfig(dbString)
+	// Credentials may contain characters reserved within URLs.
+	dbString := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(readConfig.SQLUser, readConfig.SQLPass),
+		Host:   readConfig.SQLAddress,
+		Path:   "/" + readConfig.SQLDB,
+	}
+	dbConf, err := pgxpool.ParseConfig(dbString.String())
 	checkError(err)
 	pool, err = pgxpool.ConnectConfig(ctx, dbConf)
 	checkError(err)
+	db = pool
+	prometheus.MustRegister(poolCollector{})
 
-	// Ensure this PostgreSQL connection is valid.
-	defer pool.Close()
-	checkError(err)
+	r := newServiceRoute()
+	r.MaxRequestSize = readConfig.MaxRequestSize
+
+	// Anything not otherwise handled is presumed to be SOAP.
+	// Liveness is also served here, for load balancers in front of consoles. Readiness describes
+	// our dependencies' errors, so is only served upon AdminAddress.
+	handler := http.NewServeMux()
+	handler.HandleFunc("/healthz", healthHandler)
 
-	baseUrl = readConfig.BaseURL
+	// Optionally, record all SOAP exchanges for later replay.
+	soapHandler := r.Handle()
+	var capture *CaptureWriter
+	if readConfig.CaptureDir != "" {
+		logger.Info("capturing exchanges", "directory", readConfig.CaptureDir)
+		var redactor *Redactor
+		if readConfig.CaptureRedact {
+			redactor = NewRedactor(readConfig.captureRedactElements())
+		}
+		capture, err = NewCaptureWriter(readConfig.CaptureDir, readConfig.CaptureMaxSize, readConfig.CaptureMaxFiles, redactor)
+		checkError(err)
+		soapHandler = capture.Capture(soapHandler)
+	}
+	handler.Handle("/", soapHandler)
+	newServer := func(address string, handler http.Handler) *http.Server {
+		return &http.Server{
+			Addr:         address,
+			Handler:      handler,
+			ReadTimeout:  readConfig.ReadTimeout.Duration,
+			WriteTimeout: readConfig.WriteTimeout.Duration,
+			IdleTimeout:  readConfig.IdleTimeout.Duration,
+			ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		}
+	}
 
 	// Start the HTTP server.
-	fmt.Printf("Starting HTTP connection (%s)...\nNot using the usual port for HTTP?\nBe sure to use a proxy, otherwise the Wii can't connect!\n", readConfig.Address)
+	logger.Info("starting HTTP connection", "address", readConfig.Address)
+	servers := []*http.Server{newServer(readConfig.Address, handler)}
+	listeners := []func() error{servers[0].ListenAndServe}
+
+	// Optionally, serve HTTPS ourselves.
+	if readConfig.TLSAddress != "" {
+		logger.Info("starting HTTPS connection", "address", readConfig.TLSAddress)
+		tlsServer := newServer(readConfig.TLSAddress, handler)
+		tlsServer.TLSConfig = tlsConfig(readConfig.TLSLegacy)
+		servers = append(servers, tlsServer)
+		listeners = append(listeners, func() error {
+			return tlsServer.ListenAndServeTLS(readConfig.TLSCert, readConfig.TLSKey)
+		})
+	} else {
+		logger.Warn("not serving HTTPS natively? Be sure to use a proxy, otherwise the Wii can't connect!")
+	}
 
+	// Metrics and administration are served apart from consoles.
+	if readConfig.AdminAddress != "" {
+		logger.Info("starting administrative HTTP connection", "address", readConfig.AdminAddress)
+		adminServer := newServer(readConfig.AdminAddress, adminServeMux())
+		servers = append(servers, adminServer)
+		listeners = append(listeners, adminServer.ListenAndServe)
+	}
+
+	// We'll stop accepting requests upon SIGINT or SIGTERM.
+	signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Some settings may be changed without restarting.
+	go watchConfig(signalCtx, *configPath, configRequired, readConfig.ReloadInterval.Duration)
+
+	serverErr := make(chan error, len(listeners))
+	for _, listen := range listeners {
+		go func(listen func() error) {
+			serverErr <- listen()
+		}(listen)
+	}
+
+	select {
+	case err = <-serverErr:
+		// A server could not start, or stopped unexpectedly.
+		pool.Close()
+		checkError(err)
+	case <-signalCtx.Done():
+	}
+
+	// Restore default signal behaviour, so that a second signal forcefully exits.
+	stop()
+	logger.Info("shutting down, waiting for in-flight requests...")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, readConfig.ShutdownTimeout.Duration)
+	defer cancel()
+	for _, server := range servers {
+		err = server.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("failed to drain in-flight requests", "err", err)
+		}
+	}
+
+	if capture != nil {
+		capture.Close()
+	}
+	pool.Close()
+	logger.Info("goodbye!")
+
+	// From here on out, all special cool things should go into their respective handler function.
+}
+
+// newServiceRoute returns a route with all actions for our services registered.
+func newServiceRoute() Route {
 	r := NewRoute()
 	ecs := r.HandleGroup("ecs")
 	{
-		ecs.Authenticated("CheckDeviceStatus", checkDeviceStatus)
-		ecs.Authenticated("NotifyETicketsSynced", notifyETicketsSynced)
-		ecs.Authenticated("ListETickets", listETickets)
-		ecs.Authenticated("GetETickets", getETickets)
-		ecs.Authenticated("PurchaseTitle", purchaseTitle)
-		ecs.Unauthenticated("GetECConfig", getECConfig)
-		ecs.Authenticated("ListPurchaseHistory", listPurchaseHistory)
+		ecs.Authenticated("CheckDeviceStatus", checkDeviceStatus, &CheckDeviceStatusRequest{}, &CheckDeviceStatusResponse{})
+		ecs.Authenticated("NotifyETicketsSynced", notifyETicketsSynced, &NotifyETicketsSyncedRequest{}, &Response{})
+		ecs.Authenticated("ListETickets", listETickets, &ListETicketsRequest{}, &ListETicketsResponse{})
+		ecs.Authenticated("GetETickets", getETickets, &GetETicketsRequest{}, &GetETicketsResponse{})
+		ecs.Authenticated("PurchaseTitle", purchaseTitle, &PurchaseTitleRequest{}, &PurchaseTitleResponse{})
+		ecs.Unauthenticated("GetECConfig", getECConfig, &GetECConfigRequest{}, &GetECConfigResponse{})
+		ecs.Authenticated("ListPurchaseHistory", listPurchaseHistory, &ListPurchaseHistoryRequest{}, &ListPurchaseHistoryResponse{})
 	}
 
 	ias := r.HandleGroup("ias")
 	{
-		ias.Unauthenticated("CheckRegistration", checkRegistration)
-		ias.Unauthenticated("GetChallenge", getChallenge)
-		ias.Authenticated("GetRegistrationInfo", getRegistrationInfo)
-		ias.Unauthenticated("SyncRegistration", syncRegistration)
-		ias.Unauthenticated("Register", register)
-		ias.Authenticated("Unregister", unregister)
+		ias.Unauthenticated("CheckRegistration", checkRegistration, &CheckRegistrationRequest{}, &CheckRegistrationResponse{})
+		ias.Unauthenticated("GetChallenge", getChallenge, &GetChallengeRequest{}, &GetChallengeResponse{})
+		ias.AuthenticatedAllowingExpiry("GetRegistrationInfo", getRegistrationInfo, &GetRegistrationInfoRequest{}, &GetRegistrationInfoResponse{})
+		ias.Unauthenticated("SyncRegistration", syncRegistration, &SyncRegistrationRequest{}, &SyncRegistrationResponse{})
+		ias.Unauthenticated("Register", register, &RegisterRequest{}, &RegisterResponse{})
+		ias.Authenticated("Unregister", unregister, &UnregisterRequest{}, &Response{})
 	}
-	log.Fatal(http.ListenAndServe(readConfig.Address, r.Handle()))
 
-	// From here on out, all special cool things should go into their respective handler function.
+	return r
+}
+
+// tlsConfig returns the TLS configuration for our HTTPS server.
+// The Wii's SSL library only supports TLS 1.0 with RSA key exchange,
+// both of which must be explicitly permitted via legacy.
+func tlsConfig(legacy bool) *tls.Config {
+	if !legacy {
+		return &tls.Config{}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS10,
+		CipherSuites: []uint16{
+			// Modern clients should continue to prefer these.
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+
+			// These are what the Wii is able to negotiate.
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_RC4_128_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+	}
+}
+
+// defaultConfig returns a configuration with defaults for optional values.
+func defaultConfig() Config {
+	return Config{
+		ReadTimeout:     Duration{10 * time.Second},
+		WriteTimeout:    Duration{30 * time.Second},
+		IdleTimeout:     Duration{120 * time.Second},
+		ShutdownTimeout: Duration{30 * time.Second},
+		ReloadInterval:  Duration{5 * time.Second},
+		AdminAddress:    "127.0.0.1:9090",
+		AuthCacheTTL:    Duration{30 * time.Second},
+		// Limits are disabled until the client's address can be trusted, such as via TrustProxy.
+		RateLimits: RateLimits{
+			Burst:             30,
+			AuthFailureWindow: Duration{10 * time.Minute},
+			BanDuration:       Duration{15 * time.Minute},
+		},
+		Challenges: Challenges{
+			Lifetime: Duration{5 * time.Minute},
+		},
+		DeviceCertificates: DeviceCertificates{
+			Issuer: DefaultDeviceCertificateIssuer,
+		},
+		MaxRequestSize:        DefaultMaxRequestSize,
+		CaptureMaxSize:        64 * 1024 * 1024,
+		CaptureMaxFiles:       10,
+		CaptureRedact:         true,
+		CaptureRedactElements: strings.Join(DefaultRedactedElements, ","),
+	}
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_requests_total",
+		Help: "Total handled requests, by service and action.",
+	}, []string{"service", "action"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wiisoap_request_duration_seconds",
+		Help:    "Time taken to handle requests, by service and action.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "action"})
+
+	errorCodesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_error_codes_total",
+		Help: "Total responses, by service, action and ErrorCode.",
+	}, []string{"service", "action", "code"})
+
+	rejectedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_rejected_requests_total",
+		Help: "Total requests rejected before reaching an action, by reason.",
+	}, []string{"reason"})
+
+	authenticationFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_authentication_failures_total",
+		Help: "Total requests failing authentication, by service and action.",
+	}, []string{"service", "action"})
+
+	authCacheResultsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_auth_cache_results_total",
+		Help: "Total authentication cache lookups, by whether credentials were cached.",
+	}, []string{"result"})
+
+	rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_rate_limited_total",
+		Help: "Total requests rejected by rate limits, by key type (ip or device) and reason (rate or banned).",
+	}, []string{"key", "reason"})
+
+	bansTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_bans_total",
+		Help: "Total temporary bans after repeated authentication failures, by key type (ip or device).",
+	}, []string{"key"})
+
+	bannedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wiisoap_banned_requests_total",
+		Help: "Total requests refused from banned consoles, by the kind of identifier banned.",
+	}, []string{"kind"})
+
+	registrationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wiisoap_registrations_total",
+		Help: "Total consoles successfully registered.",
+	})
+
+	purchasesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "wiisoap_purchases_total",
+		Help: "Total titles purchased.",
+	})
+)
+
+// observeResponse records the outcome of an action.
+func observeResponse(action Action, errorCode int) {
+	requestsTotal.WithLabelValues(action.ServiceType, action.ActionName).Inc()
+	errorCodesTotal.WithLabelValues(action.ServiceType, action.ActionName, strconv.Itoa(errorCode)).Inc()
+}
+
+// poolCollector exposes statistics for our PostgreSQL connection pool.
+type poolCollector struct{}
+
+var (
+	poolAcquiredConns = prometheus.NewDesc("wiisoap_db_acquired_connections",
+		"Connections currently in use.", nil, nil)
+	poolIdleConns = prometheus.NewDesc("wiisoap_db_idle_connections",
+		"Connections currently idle.", nil, nil)
+	poolConstructingConns = prometheus.NewDesc("wiisoap_db_constructing_connections",
+		"Connections currently being established.", nil, nil)
+	poolTotalConns = prometheus.NewDesc("wiisoap_db_total_connections",
+		"Total connections currently open.", nil, nil)
+	poolMaxConns = prometheus.NewDesc("wiisoap_db_max_connections",
+		"Maximum size of the connection pool.", nil, nil)
+	poolAcquireCount = prometheus.NewDesc("wiisoap_db_acquires_total",
+		"Total successful connection acquisitions.", nil, nil)
+	poolEmptyAcquireCount = prometheus.NewDesc("wiisoap_db_empty_acquires_total",
+		"Total acquisitions which waited for a connection as none were idle.", nil, nil)
+	poolCanceledAcquireCount = prometheus.NewDesc("wiisoap_db_canceled_acquires_total",
+		"Total acquisitions canceled by their context.", nil, nil)
+	poolAcquireDuration = prometheus.NewDesc("wiisoap_db_acquire_duration_seconds_total",
+		"Total time spent acquiring connections.", nil, nil)
+)
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredConns
+	ch <- poolIdleConns
+	ch <- poolConstructingConns
+	ch <- poolTotalConns
+	ch <- poolMaxConns
+	ch <- poolAcquireCount
+	ch <- poolEmptyAcquireCount
+	ch <- poolCanceledAcquireCount
+	ch <- poolAcquireDuration
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := pool.Stat()
+
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolConstructingConns, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
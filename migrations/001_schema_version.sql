@@ -0,0 +1,14 @@
+-- Upgrades a database created from the original database.sql to schema version 1.
+-- Versions are recorded from here onwards, so that readiness checks can tell which migrations remain.
+
+BEGIN;
+
+CREATE TABLE public.schema_version (
+    version integer NOT NULL
+);
+ALTER TABLE public.schema_version OWNER TO wiisoap;
+COMMENT ON TABLE public.schema_version IS 'Version of this schema, checked by WiiSOAP for readiness.';
+
+INSERT INTO public.schema_version (version) VALUES (1);
+
+COMMIT;
@@ -0,0 +1,13 @@
+-- Upgrades a database from schema version 1 to 2.
+-- Plaintext device tokens are no longer stored. Existing tokens remain valid,
+-- as authentication only relies upon their md5.
+
+BEGIN;
+
+DROP INDEX public.userbase_device_token_uindex;
+ALTER TABLE public.userbase DROP COLUMN device_token;
+CREATE UNIQUE INDEX userbase_device_token_hashed_uindex ON public.userbase USING btree (device_token_hashed);
+
+UPDATE public.schema_version SET version = 2;
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Upgrades a database from schema version 2 to 3.
+-- Existing tokens are considered issued upon upgrading.
+
+BEGIN;
+
+ALTER TABLE public.userbase ADD COLUMN device_token_issued timestamp without time zone DEFAULT now() NOT NULL;
+COMMENT ON COLUMN public.userbase.device_token_issued IS 'When the current device token was issued, in UTC.';
+
+UPDATE public.schema_version SET version = 3;
+
+COMMIT;
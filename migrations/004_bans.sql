@@ -0,0 +1,19 @@
+-- Upgrades a database from schema version 3 to 4.
+
+BEGIN;
+
+CREATE TABLE public.bans (
+    kind character varying(16) NOT NULL,
+    value character varying(20) NOT NULL,
+    reason text,
+    expires timestamp without time zone,
+    created timestamp without time zone DEFAULT now() NOT NULL,
+    CONSTRAINT bans_pk PRIMARY KEY (kind, value)
+);
+ALTER TABLE public.bans OWNER TO wiisoap;
+COMMENT ON TABLE public.bans IS 'Consoles and accounts refused service. Kind is one of device_id, serial_number, device_code or account_id.';
+COMMENT ON COLUMN public.bans.expires IS 'When the ban is lifted, in UTC, or null if permanent.';
+
+UPDATE public.schema_version SET version = 4;
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Upgrades a database from schema version 4 to 5.
+-- Consoles registered beforehand have no certificate stored.
+
+BEGIN;
+
+ALTER TABLE public.userbase ADD COLUMN device_cert bytea;
+COMMENT ON COLUMN public.userbase.device_cert IS 'Device certificate presented upon registering, allowing eTickets to be personalised.';
+
+UPDATE public.schema_version SET version = 5;
+
+COMMIT;
@@ -0,0 +1,16 @@
+-- Upgrades a database from schema version 5 to 6.
+
+BEGIN;
+
+CREATE TABLE public.challenges (
+    device_id bigint NOT NULL,
+    challenge character varying(11) NOT NULL,
+    expires timestamp without time zone NOT NULL,
+    CONSTRAINT challenges_pk PRIMARY KEY (device_id)
+);
+ALTER TABLE public.challenges OWNER TO wiisoap;
+COMMENT ON TABLE public.challenges IS 'Challenges issued by GetChallenge in strict mode, awaiting their return. Expiry is in UTC.';
+
+UPDATE public.schema_version SET version = 6;
+
+COMMIT;
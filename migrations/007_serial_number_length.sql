@@ -0,0 +1,10 @@
+-- Upgrades a database from schema version 6 to 7.
+-- Serial numbers of three letters and nine digits, which registration accepts, are twelve characters long.
+
+BEGIN;
+
+ALTER TABLE public.userbase ALTER COLUMN serial_number TYPE character varying(12);
+
+UPDATE public.schema_version SET version = 7;
+
+COMMIT;
@@ -0,0 +1,11 @@
+-- Upgrades a database from schema version 7 to 8.
+-- Consoles may hold several challenges at once, so that others requesting one cannot replace theirs.
+
+BEGIN;
+
+ALTER TABLE public.challenges DROP CONSTRAINT challenges_pk;
+ALTER TABLE public.challenges ADD CONSTRAINT challenges_pk PRIMARY KEY (device_id, challenge);
+
+UPDATE public.schema_version SET version = 8;
+
+COMMIT;
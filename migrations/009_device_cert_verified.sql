@@ -0,0 +1,11 @@
+-- Upgrades a database from schema version 8 to 9.
+-- Certificates stored beforehand are not known to have been verified, so are no longer relied upon.
+
+BEGIN;
+
+ALTER TABLE public.userbase ADD COLUMN device_cert_verified boolean DEFAULT false NOT NULL;
+COMMENT ON COLUMN public.userbase.device_cert_verified IS 'Whether device_cert was verified against the MS public key upon registering, and may prove the console''s identity.';
+
+UPDATE public.schema_version SET version = 9;
+
+COMMIT;
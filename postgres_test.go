@@ -0,0 +1,174 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDatabaseEnvironment names a PostgreSQL URL to test against, such as
+// postgres://postgres@127.0.0.1:5432/wiisoap_test. Everything within its public schema is erased,
+// and its user must be able to create, or be, the wiisoap role owning our tables.
+const testDatabaseEnvironment = "WIISOAP_TEST_DATABASE"
+
+// resetSchemaStatement empties the test database, ensuring the role database.sql assigns ownership to exists.
+const resetSchemaStatement = `DROP SCHEMA IF EXISTS public CASCADE;
+CREATE SCHEMA public;
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'wiisoap') THEN
+		CREATE ROLE wiisoap;
+	END IF;
+END $$;`
+
+// describeSchemaStatements list the columns and indexes of our tables, so that schemas may be compared.
+var describeSchemaStatements = []string{
+	`SELECT table_name || '.' || column_name || ' ' || data_type || COALESCE('(' || character_maximum_length || ')', '') ||
+		CASE WHEN is_nullable = 'NO' THEN ' NOT NULL' ELSE '' END
+	FROM information_schema.columns WHERE table_schema = 'public' ORDER BY table_name, column_name`,
+	`SELECT indexname || ' ' || indexdef FROM pg_indexes WHERE schemaname = 'public' ORDER BY indexname`,
+}
+
+// createSchema erases the test database, then applies the given files in order.
+func createSchema(t *testing.T, url string, files []string) *pgxpool.Pool {
+	// Files may alter settings such as search_path, so are applied using a connection of their own.
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, resetSchemaStatement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Exec(ctx, string(contents))
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+	}
+
+	pool, err := pgxpool.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// describeSchema returns a description of every column and index.
+func describeSchema(t *testing.T, pool *pgxpool.Pool) []string {
+	var description []string
+	for _, statement := range describeSchemaStatements {
+		rows, err := pool.Query(ctx, statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var line string
+			err = rows.Scan(&line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			description = append(description, line)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			t.Fatal(rows.Err())
+		}
+	}
+
+	return description
+}
+
+// seedPostgreSQL replaces the contents of every table with the test console and the given case's fixtures,
+// inserting them as WiiSOAP itself would wherever possible.
+func seedPostgreSQL(t *testing.T, pool *pgxpool.Pool, c conformanceCase) {
+	fixtures := newTestDatabase()
+	fixtures.users = append(fixtures.users, c.Users...)
+	fixtures.ownedTitles = append(fixtures.ownedTitles, c.OwnedTitles...)
+	fixtures.bans = c.Bans
+	fixtures.challenges = c.Challenges
+
+	_, err := pool.Exec(ctx, `TRUNCATE owned_titles, shop_titles, userbase, bans, challenges`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(sql string, args ...interface{}) {
+		t.Helper()
+		_, err := pool.Exec(ctx, sql, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	for _, user := range fixtures.users {
+		insert(PrepareUserStatement, user.DeviceId, user.DeviceTokenHashed, user.AccountId, user.Region, user.Country, user.Language, user.SerialNumber, user.DeviceCode, user.TokenIssued, user.DeviceCert, user.DeviceCertVerified)
+	}
+	for _, title := range fixtures.ownedTitles {
+		insert(`INSERT INTO shop_titles (title_id, version) VALUES ($1, $2) ON CONFLICT DO NOTHING`, title.TitleId, title.Version)
+		insert(`INSERT INTO owned_titles (account_id, ticket_id, title_id, revocation_date) VALUES ($1, $2, $3, $4)`, title.AccountId, title.TicketId, title.TitleId, title.RevocationDate)
+	}
+	for _, ban := range fixtures.bans {
+		insert(AddBanStatement, ban.Kind, ban.Value, ban.Reason, ban.Expires, ban.Created)
+	}
+	for _, challenge := range fixtures.challenges {
+		insert(IssueChallengeStatement, challenge.DeviceId, challenge.Challenge, challenge.Expires)
+	}
+}
+
+// TestPostgreSQL creates the schema both from database.sql, and by migrating that originally released,
+// ensuring they are identical before running every conformance case against each.
+func TestPostgreSQL(t *testing.T) {
+	url := os.Getenv(testDatabaseEnvironment)
+	if url == "" {
+		t.Skipf("set %s to test against PostgreSQL", testDatabaseEnvironment)
+	}
+	if *update {
+		t.Skip("golden files are only updated from the in-memory database")
+	}
+
+	migrations, err := filepath.Glob(filepath.Join("migrations", "*.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := []struct {
+		Name  string
+		Files []string
+	}{
+		{"database.sql", []string{"database.sql"}},
+		{"migrations", append([]string{filepath.Join("testdata", "postgres", "database.original.sql")}, migrations...)},
+	}
+
+	var expected []string
+	for _, schema := range schemas {
+		t.Run(schema.Name, func(t *testing.T) {
+			pool := createSchema(t, url, schema.Files)
+			description := describeSchema(t, pool)
+			if expected == nil {
+				expected = description
+			} else if !reflect.DeepEqual(description, expected) {
+				t.Errorf("schema differs from database.sql:\n%s", strings.Join(diffLines(expected, description), "\n"))
+			}
+
+			db = pool
+			err := checkMigrations(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runConformance(t, func(t *testing.T, c conformanceCase) Database {
+				seedPostgreSQL(t, pool, c)
+				return pool
+			})
+		})
+	}
+}
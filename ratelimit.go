@@ -0,0 +1,221 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiterSweepInterval is how often idle buckets, failure counts and expired bans are forgotten.
+const rateLimiterSweepInterval = time.Minute
+
+// tokenBucket permits bursts of requests up to its capacity, refilling at a constant rate.
+type tokenBucket struct {
+	Tokens  float64
+	Rate    float64
+	Burst   int
+	Updated time.Time
+}
+
+// failureCount tracks authentication failures within a window.
+type failureCount struct {
+	Count int
+	Start time.Time
+}
+
+// rateLimiter enforces RateLimits for clients, identified by keys such as "ip:192.0.2.1" or "device:4362227770".
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	failures  map[string]*failureCount
+	bans      map[string]time.Time
+	lastSweep time.Time
+}
+
+var limiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:  map[string]*tokenBucket{},
+		failures: map[string]*failureCount{},
+		bans:     map[string]time.Time{},
+	}
+}
+
+// limitFor returns the rate and burst applying to the given action.
+func (r *RateLimits) limitFor(service string, action string) (float64, int) {
+	for _, override := range r.Actions {
+		if override.Action == action && (override.Service == "" || override.Service == service) {
+			return override.Rate, override.Burst
+		}
+	}
+
+	return r.Rate, r.Burst
+}
+
+// Allow takes a token from the bucket for key, returning how long until one is available if empty.
+// A rate of zero disables limiting.
+func (l *rateLimiter) Allow(key string, rate float64, burst int) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := now()
+	l.sweep(current)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{Tokens: float64(burst), Updated: current}
+		l.buckets[key] = bucket
+	}
+
+	elapsed := current.Sub(bucket.Updated).Seconds()
+	bucket.Tokens = math.Min(float64(burst), bucket.Tokens+elapsed*rate)
+	bucket.Rate = rate
+	bucket.Burst = burst
+	bucket.Updated = current
+
+	if bucket.Tokens < 1 {
+		return false, time.Duration((1 - bucket.Tokens) / rate * float64(time.Second))
+	}
+
+	bucket.Tokens--
+	return true, 0
+}
+
+// Banned returns how long key remains banned for, if at all.
+func (l *rateLimiter) Banned(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.bans[key]
+	if !ok {
+		return 0, false
+	}
+
+	remaining := until.Sub(now())
+	if remaining <= 0 {
+		delete(l.bans, key)
+		return 0, false
+	}
+	return remaining, true
+}
+
+// RecordFailure counts an authentication failure for key, banning it once limit failures occur within window.
+// It returns whether key was newly banned. A limit of zero disables banning.
+func (l *rateLimiter) RecordFailure(key string, limit int, window time.Duration, ban time.Duration) bool {
+	if limit <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current := now()
+	failures, ok := l.failures[key]
+	if !ok || current.Sub(failures.Start) > window {
+		failures = &failureCount{Start: current}
+		l.failures[key] = failures
+	}
+
+	failures.Count++
+	if failures.Count < limit {
+		return false
+	}
+
+	delete(l.failures, key)
+	l.bans[key] = current.Add(ban)
+	return true
+}
+
+// sweep forgets state which no longer has any effect. The lock must be held.
+func (l *rateLimiter) sweep(current time.Time) {
+	if current.Sub(l.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	l.lastSweep = current
+
+	limits := settings().RateLimits
+	for key, bucket := range l.buckets {
+		// Buckets idle long enough to have refilled are indistinguishable from new ones.
+		// Slowly refilling buckets may take far longer than a sweep interval to do so.
+		if bucket.Tokens+current.Sub(bucket.Updated).Seconds()*bucket.Rate >= float64(bucket.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	for key, failures := range l.failures {
+		if current.Sub(failures.Start) > limits.AuthFailureWindow.Duration {
+			delete(l.failures, key)
+		}
+	}
+	for key, until := range l.bans {
+		if current.After(until) {
+			delete(l.bans, key)
+		}
+	}
+}
+
+// clientIP returns the address of the client making a request.
+// If TrustProxy is set, the address appended to X-Forwarded-For by our proxy is used.
+func clientIP(r *http.Request) string {
+	if settings().RateLimits.TrustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) != 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkRateLimit determines whether the client identified by key may perform the given action,
+// responding with 429 Too Many Requests if not.
+func checkRateLimit(w http.ResponseWriter, log *slog.Logger, key string, service string, action string) bool {
+	kind := key[:strings.IndexByte(key, ':')]
+
+	if remaining, banned := limiter.Banned(key); banned {
+		rateLimitedTotal.WithLabelValues(kind, "banned").Inc()
+		log.Debug("rejected request from banned client", "key", key)
+		tooManyRequests(w, remaining)
+		return false
+	}
+
+	limits := settings().RateLimits
+	rate, burst := limits.limitFor(service, action)
+	if allowed, retryAfter := limiter.Allow(key+"/"+service+"/"+action, rate, burst); !allowed {
+		rateLimitedTotal.WithLabelValues(kind, "rate").Inc()
+		log.Warn("rate limit exceeded", "key", key, "rate", rate, "burst", burst)
+		tooManyRequests(w, retryAfter)
+		return false
+	}
+
+	return true
+}
+
+// recordAuthenticationFailure counts a failure against the client's IP key, banning it if failing too often.
+// Failures are never counted against device IDs, as anyone may claim any, and could so ban another's console.
+func recordAuthenticationFailure(log *slog.Logger, ipKey string) {
+	limits := settings().RateLimits
+	if limiter.RecordFailure(ipKey, limits.AuthFailures, limits.AuthFailureWindow.Duration, limits.BanDuration.Duration) {
+		bansTotal.WithLabelValues(ipKey[:strings.IndexByte(ipKey, ':')]).Inc()
+		log.Warn("temporarily banned client after repeated authentication failures", "key", ipKey, "duration", limits.BanDuration.Duration)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too many requests.", http.StatusTooManyRequests)
+}
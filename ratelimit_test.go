@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticationFailureBans(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	config.RateLimits.AuthFailures = 2
+	config.RateLimits.AuthFailureWindow = Duration{time.Minute}
+	config.RateLimits.BanDuration = Duration{time.Minute}
+	config.RateLimits.TrustProxy = true
+	currentConfig.Store(&config)
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	valid, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.unauthorized.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(invalid), "4362227770") {
+		t.Fatal("the unauthorized request must claim to be the test console")
+	}
+	send := func(address string, body []byte) int {
+		request := soapRequest("ecs", "CheckDeviceStatus", body)
+		request.Header.Set("X-Forwarded-For", address)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// Another client repeatedly fails to authenticate as the test console.
+	steps := []struct {
+		Name    string
+		Address string
+		Body    []byte
+		Status  int
+	}{
+		{"first failure", "192.0.2.1", invalid, http.StatusUnauthorized},
+		{"second failure", "192.0.2.1", invalid, http.StatusUnauthorized},
+		{"banned", "192.0.2.1", valid, http.StatusTooManyRequests},
+		// Only the failing address is banned, not the console it claimed to be.
+		{"console", "198.51.100.1", valid, http.StatusOK},
+	}
+	for _, step := range steps {
+		if status := send(step.Address, step.Body); status != step.Status {
+			t.Errorf("%s: status %d, expected %d", step.Name, status, step.Status)
+		}
+	}
+}
+
+func TestDeviceLimitsAfterAuthentication(t *testing.T) {
+	setupTestServer(t)
+	config := *settings()
+	config.RateLimits.Rate = 0.001
+	config.RateLimits.Burst = 1
+	config.RateLimits.TrustProxy = true
+	currentConfig.Store(&config)
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	valid, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid, err := os.ReadFile(filepath.Join("testdata", "conformance", "ecs", "CheckDeviceStatus.unauthorized.request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request comes from another address, so that only the device's limit applies.
+	steps := []struct {
+		Name    string
+		Address string
+		Body    []byte
+		Status  int
+	}{
+		{"claiming the console", "192.0.2.1", invalid, http.StatusUnauthorized},
+		{"console", "198.51.100.1", valid, http.StatusOK},
+		{"console again", "198.51.100.2", valid, http.StatusTooManyRequests},
+	}
+	for _, step := range steps {
+		request := soapRequest("ecs", "CheckDeviceStatus", step.Body)
+		request.Header.Set("X-Forwarded-For", step.Address)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != step.Status {
+			t.Errorf("%s: status %d, expected %d", step.Name, recorder.Code, step.Status)
+		}
+	}
+}
+
+func TestSweepKeepsRefillingBuckets(t *testing.T) {
+	setupTestServer(t)
+	limiter := newRateLimiter()
+
+	// Long after a sweep interval, a slowly refilling bucket remains empty.
+	if allowed, _ := limiter.Allow("ip:192.0.2.1/ias/Register", 0.001, 1); !allowed {
+		t.Fatal("first request was limited")
+	}
+	now = func() time.Time {
+		return testTime.Add(2 * rateLimiterSweepInterval)
+	}
+	if allowed, _ := limiter.Allow("ip:192.0.2.1/ias/Register", 0.001, 1); allowed {
+		t.Error("the bucket was refilled by sweeping")
+	}
+	if _, ok := limiter.buckets["ip:192.0.2.1/ias/Register"]; !ok {
+		t.Error("the bucket was swept")
+	}
+
+	// Once refilled, it is forgotten.
+	now = func() time.Time {
+		return testTime.Add(2*rateLimiterSweepInterval + 2000*time.Second)
+	}
+	limiter.Allow("ip:192.0.2.2/ias/Register", 0.001, 1)
+	if _, ok := limiter.buckets["ip:192.0.2.1/ias/Register"]; ok {
+		t.Error("the refilled bucket was kept")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// volatileElements differ between otherwise identical responses, and are not compared.
+var volatileElements = regexp.MustCompile(`(<(?:\w+:)?(TimeStamp|SyncTime|ExtTicketTime|Date|DeviceToken|AccountId)>)[^<]*(</(?:\w+:)?(TimeStamp|SyncTime|ExtTicketTime|Date|DeviceToken|AccountId)>)`)
+
+// redactedElements matches elements whose contents were redacted upon capture.
+var redactedElements = regexp.MustCompile(`<(?:\w+:)?(\w+)>REDACTED</`)
+
+// redactLike redacts the elements within response which were redacted within captured,
+// so that they are not reported as differing.
+func redactLike(captured string, response string) string {
+	var elements []string
+	for _, match := range redactedElements.FindAllStringSubmatch(captured, -1) {
+		elements = append(elements, match[1])
+	}
+
+	return NewRedactor(elements).Document(response)
+}
+
+// replayCommand sends captured requests against a server, reporting differences from the captured responses.
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "http://127.0.0.1:8080", "base URL of the server to replay against")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout for each request")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: WiiSOAP replay [flags] capture.jsonl...")
+		fmt.Fprintln(flags.Output(), "Captured device tokens and console identifiers are typically redacted, so authenticated requests and registrations may fail.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	// Lines which are not exchanges are counted apart from those replayed.
+	total, differing, failed, unparseable := 0, 0, 0, 0
+	for _, path := range flags.Args() {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64*1024*1024)
+		line := 0
+		for scanner.Scan() {
+			line++
+			var exchange Exchange
+			err = json.Unmarshal(scanner.Bytes(), &exchange)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, line, err)
+				unparseable++
+				continue
+			}
+
+			total++
+			status, response, err := replayExchange(client, *target, exchange)
+			if err != nil {
+				fmt.Printf("%s:%d %s %s: %v\n", path, line, exchange.Method, exchange.Headers.Get("SOAPAction"), err)
+				failed++
+				continue
+			}
+
+			diff := diffLines(normaliseResponse(exchange.Response), normaliseResponse(redactLike(exchange.Response, response)))
+			if status != exchange.Status || diff != nil {
+				differing++
+				fmt.Printf("%s:%d %s %s: status %d, expected %d\n", path, line, exchange.Method, exchange.Headers.Get("SOAPAction"), status, exchange.Status)
+				for _, diffLine := range diff {
+					fmt.Println(diffLine)
+				}
+			}
+		}
+
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+	}
+
+	fmt.Printf("Replayed %d exchanges: %d matched, %d differed, %d failed.\n", total, total-differing-failed, differing, failed)
+	if unparseable != 0 {
+		fmt.Printf("%d lines were not exchanges, and were skipped.\n", unparseable)
+	}
+	if differing != 0 || failed != 0 || unparseable != 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayExchange sends a captured request to the target, returning the status and body of its response.
+func replayExchange(client *http.Client, target string, exchange Exchange) (int, string, error) {
+	request, err := http.NewRequest(exchange.Method, strings.TrimSuffix(target, "/")+exchange.URL, strings.NewReader(exchange.Body))
+	if err != nil {
+		return 0, "", err
+	}
+	for name, values := range exchange.Headers {
+		if name == "Content-Length" {
+			continue
+		}
+		request.Header[name] = values
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return response.StatusCode, string(body), nil
+}
+
+// normaliseResponse masks volatile elements and splits a response into indented lines for comparison.
+// Responses which are not XML are compared as-is.
+func normaliseResponse(response string) []string {
+	response = volatileElements.ReplaceAllString(response, "${1}*${3}")
+
+	decoder := xml.NewDecoder(strings.NewReader(response))
+	var indented bytes.Buffer
+	encoder := xml.NewEncoder(&indented)
+	encoder.Indent("", "  ")
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return strings.Split(response, "\n")
+		}
+
+		// Whitespace between elements is not significant.
+		if charData, ok := token.(xml.CharData); ok && len(bytes.TrimSpace(charData)) == 0 {
+			continue
+		}
+		if _, ok := token.(xml.ProcInst); ok {
+			continue
+		}
+
+		err = encoder.EncodeToken(token)
+		if err != nil {
+			return strings.Split(response, "\n")
+		}
+	}
+	encoder.Flush()
+
+	return strings.Split(indented.String(), "\n")
+}
+
+// diffLines returns a line-based diff between the expected and actual lines, or nil if they are identical.
+func diffLines(expected []string, actual []string) []string {
+	// lengths[i][j] is the longest common subsequence of expected[i:] and actual[j:].
+	lengths := make([][]int, len(expected)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(actual)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(actual) - 1; j >= 0; j-- {
+			if expected[i] == actual[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var diff []string
+	changed := false
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case i < len(expected) && j < len(actual) && expected[i] == actual[j]:
+			diff = append(diff, "  "+expected[i])
+			i++
+			j++
+		case i < len(expected) && (j == len(actual) || lengths[i+1][j] >= lengths[i][j+1]):
+			diff = append(diff, "- "+expected[i])
+			changed = true
+			i++
+		default:
+			diff = append(diff, "+ "+actual[j])
+			changed = true
+			j++
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return diff
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Expected string
+		Actual   string
+		Diff     []string
+	}{
+		{"identical", "a\nb\nc", "a\nb\nc", nil},
+		{"empty", "", "", nil},
+		{"changed", "a\nb\nc", "a\nx\nc", []string{"  a", "- b", "+ x", "  c"}},
+		{"added", "a\nc", "a\nb\nc", []string{"  a", "+ b", "  c"}},
+		{"removed", "a\nb\nc", "a\nc", []string{"  a", "- b", "  c"}},
+		{"appended", "a", "a\nb", []string{"  a", "+ b"}},
+		{"replaced", "a", "b", []string{"- a", "+ b"}},
+	}
+	for _, c := range cases {
+		diff := diffLines(strings.Split(c.Expected, "\n"), strings.Split(c.Actual, "\n"))
+		if !reflect.DeepEqual(diff, c.Diff) {
+			t.Errorf("%s: diff is %q, expected %q", c.Name, diff, c.Diff)
+		}
+	}
+}
+
+func TestNormaliseResponse(t *testing.T) {
+	captured := `<?xml version="1.0"?><Envelope><Response><TimeStamp>1</TimeStamp><DeviceCode>REDACTED</DeviceCode><Balance>5</Balance></Response></Envelope>`
+	replayed := "<Envelope>\n  <Response>\n    <TimeStamp>2</TimeStamp>\n    <DeviceCode>1234567890123516</DeviceCode>\n    <Balance>5</Balance>\n  </Response>\n</Envelope>"
+
+	if diff := diffLines(normaliseResponse(captured), normaliseResponse(redactLike(captured, replayed))); diff != nil {
+		t.Errorf("equivalent responses differ:\n%s", strings.Join(diff, "\n"))
+	}
+
+	altered := strings.Replace(replayed, "<Balance>5</Balance>", "<Balance>6</Balance>", 1)
+	if diff := diffLines(normaliseResponse(captured), normaliseResponse(redactLike(captured, altered))); diff == nil {
+		t.Error("differing responses were considered equivalent")
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"github.com/jackc/pgx/v4"
-	"github.com/logrusorgru/aurora/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 )
 
 // Route defines a header to be checked for actions, and an array of actions to handle.
 type Route struct {
 	HeaderName string
 	Actions    []Action
+
+	// MaxRequestSize limits the size of request bodies, in bytes.
+	MaxRequestSize int64
 }
 
 // Action contains information about how a specified action should be handled.
@@ -21,12 +28,29 @@ type Action struct {
 	Callback            func(e *Envelope)
 	NeedsAuthentication bool
 	ServiceType         string
+
+	// AllowsExpiredToken permits authentication with an expired device token,
+	// for actions through which consoles refresh their token.
+	AllowsExpiredToken bool
+
+	// Request and Response are prototypes describing this action's format.
+	Request  interface{}
+	Response Responder
+}
+
+// services maps known service types to the name of their SOAP port, without its "SOAP" suffix.
+var services = map[string]string{
+	"ecs": "ECommerce",
+	"ias": "IdentityAuthentication",
+	"cas": "Cataloging",
+	"nus": "NetUpdate",
 }
 
 // NewRoute produces a new route struct with appropriate header defaults.
 func NewRoute() Route {
 	return Route{
-		HeaderName: "SOAPAction",
+		HeaderName:     "SOAPAction",
+		MaxRequestSize: DefaultMaxRequestSize,
 	}
 }
 
@@ -45,51 +69,90 @@ func (r *Route) HandleGroup(serviceType string) RoutingGroup {
 }
 
 // Unauthenticated associates an action to a function to be handled without authentication.
-func (r *RoutingGroup) Unauthenticated(action string, function func(e *Envelope)) {
+// The given request and response describe the action's format.
+func (r *RoutingGroup) Unauthenticated(action string, function func(e *Envelope), request interface{}, response Responder) {
 	r.Route.Actions = append(r.Route.Actions, Action{
 		ActionName:          action,
 		Callback:            function,
 		NeedsAuthentication: false,
 		ServiceType:         r.ServiceType,
+		Request:             request,
+		Response:            response,
+	})
+}
+
+// AuthenticatedAllowingExpiry associates an action to a function to be handled with authentication,
+// permitting device tokens which have expired. The given request and response describe the action's format.
+func (r *RoutingGroup) AuthenticatedAllowingExpiry(action string, function func(e *Envelope), request interface{}, response Responder) {
+	r.Route.Actions = append(r.Route.Actions, Action{
+		ActionName:          action,
+		Callback:            function,
+		NeedsAuthentication: true,
+		AllowsExpiredToken:  true,
+		ServiceType:         r.ServiceType,
+		Request:             request,
+		Response:            response,
 	})
 }
 
 // Authenticated associates an action to a function to be handled with authentication.
-func (r *RoutingGroup) Authenticated(action string, function func(e *Envelope)) {
+// The given request and response describe the action's format.
+func (r *RoutingGroup) Authenticated(action string, function func(e *Envelope), request interface{}, response Responder) {
 	r.Route.Actions = append(r.Route.Actions, Action{
 		ActionName:          action,
 		Callback:            function,
 		NeedsAuthentication: true,
 		ServiceType:         r.ServiceType,
+		Request:             request,
+		Response:            response,
 	})
 }
 
 func (route *Route) Handle() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s via %s", aurora.Yellow(r.Method), aurora.Cyan(r.URL), aurora.Cyan(r.Host))
+		requestLog := logger.With("remote_addr", r.RemoteAddr)
+		requestLog.Info("incoming request", "method", r.Method, "url", r.URL.String(), "host", r.Host)
+
+		// Service descriptions are requested separately from actions.
+		if r.Method == "GET" && isWSDLRequest(r) {
+			route.serveWSDL(w, r, requestLog)
+			return
+		}
 
 		// Check if there's a header of the type we need.
 		service, actionName := parseAction(r.Header.Get("SOAPAction"))
 		if service == "" || actionName == "" || r.Method != "POST" {
-			printError(w, "WiiSOAP can't handle this. Try again later.")
+			rejectedRequestsTotal.WithLabelValues("invalid_action").Inc()
+			printError(w, requestLog, "WiiSOAP can't handle this. Try again later.")
 			return
 		}
 
 		// Verify this is a service type we know.
-		switch service {
-		case "ecs":
-		case "ias":
-		case "cas":
-			break
-		default:
-			printError(w, "Unsupported service type...")
+		if _, ok := services[service]; !ok {
+			rejectedRequestsTotal.WithLabelValues("unsupported_service").Inc()
+			printError(w, requestLog, "Unsupported service type...")
+			return
+		}
+
+		requestLog = requestLog.With("service", service, "action", actionName)
+		requestLog.Debug("handling request")
+
+		// Clients are limited before we spend any effort on their request.
+		ipKey := "ip:" + clientIP(r)
+		if !checkRateLimit(w, requestLog, ipKey, service, actionName) {
 			return
 		}
 
-		debugPrint("[!] Incoming ", aurora.Yellow(strings.ToUpper(service)), " request - handling request ", aurora.Yellow(actionName))
-		body, err := ioutil.ReadAll(r.Body)
+		// Read at most one byte past our limit, so we can tell if it was exceeded.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, route.MaxRequestSize+1))
 		if err != nil {
-			printError(w, "Error reading request body...")
+			printError(w, requestLog, "Error reading request body...")
+			return
+		}
+		if int64(len(body)) > route.MaxRequestSize {
+			rejectedRequestsTotal.WithLabelValues("too_large").Inc()
+			http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+			requestLog.Warn("failed to handle request", "reason", "request body exceeds maximum size")
 			return
 		}
 
@@ -104,81 +167,152 @@ func (route *Route) Handle() http.Handler {
 
 		// Action is only properly populated if we found it previously.
 		if action.ActionName == "" && action.ServiceType == "" {
-			printError(w, "WiiSOAP can't handle this. Try again later.")
+			rejectedRequestsTotal.WithLabelValues("unknown_action").Inc()
+			printError(w, requestLog, "WiiSOAP can't handle this. Try again later.")
 			return
 		}
 
-		debugPrint("Client sent:\n", aurora.BrightGreen(string(body)))
+		timer := prometheus.NewTimer(requestDuration.WithLabelValues(service, actionName))
+		defer timer.ObserveDuration()
+
+		// Bodies hold credentials, which must not reach our logs.
+		requestLog.Debug("client sent request", "body", redactTokens(string(body)))
 
 		// Insert the current action being performed.
 		e, err := NewEnvelope(service, actionName, body)
 		if err != nil {
-			printError(w, "Error interpreting request body: "+err.Error())
+			rejectedRequestsTotal.WithLabelValues("malformed").Inc()
+			printError(w, requestLog, "Error interpreting request body: "+err.Error())
 			return
 		}
+		e.logger = requestLog.With("device_id", e.DeviceId(), "message_id", e.common.MessageId)
+		if accountId, err := e.AccountId(); err == nil && accountId != 0 {
+			e.logger = e.logger.With("account_id", accountId)
+		}
 
 		// Check for authentication.
 		if action.NeedsAuthentication {
-			success, err := checkAuthentication(e)
+			success, ban, err := checkAuthentication(e)
+			if err == errTokenExpired && action.AllowsExpiredToken {
+				success, err = true, nil
+			}
 			// Catch-all in case of invalid formatting or true invalidity.
 			if !success || (err != nil) {
+				authenticationFailuresTotal.WithLabelValues(service, actionName).Inc()
+				e.logger.Warn("authentication failed", "err", err)
+				// Consoles with expired tokens are not necessarily misbehaving.
+				if err != errTokenExpired {
+					recordAuthenticationFailure(e.logger, ipKey)
+				}
 				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
 				return
 			}
+
+			// Bans are only checked once authenticated, so that others cannot learn of them by claiming a console's identity.
+			// Unauthenticated actions check those identifiers they are presented with themselves.
+			if ban != nil {
+				refuseBanned(e, service, ban, true)
+				writeResponse(w, e, action)
+				return
+			}
+
+			// Devices are only limited once authenticated, as others could otherwise exhaust a console's limit by claiming its ID.
+			deviceKey := "device:" + strconv.Itoa(e.DeviceId())
+			if !checkRateLimit(w, e.logger, deviceKey, service, actionName) {
+				return
+			}
 		}
 
 		// Call this action.
 		action.Callback(e)
 
 		// The action has now finished its task, and we can serialize.
-		// Output may or may not truly be XML depending on where things failed.
-		// We'll expect the best, however.
-		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
-		success, contents := e.becomeXML()
-		if !success {
-			// This is not what we wanted, and we need to reflect that.
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		w.Write([]byte(contents))
-		debugPrint("Writing response:\n", aurora.BrightCyan(contents))
+		writeResponse(w, e, action)
 	})
 }
 
+// writeResponse serializes the response an action has settled upon.
+func writeResponse(w http.ResponseWriter, e *Envelope, action Action) {
+	// Output may or may not truly be XML depending on where things failed.
+	// We'll expect the best, however.
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	success, contents := e.becomeXML()
+	observeResponse(action, e.Body.Response.common().ErrorCode)
+	if !success {
+		// This is not what we wanted, and we need to reflect that.
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(contents))
+	e.logger.Debug("writing response", "error_code", e.Body.Response.common().ErrorCode, "body", redactTokens(contents))
+}
+
 const (
-	RouteVerifyStatement = `SELECT device_id FROM userbase WHERE device_token_hashed=$1 AND account_id=$2 AND device_id=$3`
+	RouteVerifyStatement = `SELECT device_token_hashed, device_token_issued FROM userbase WHERE account_id=$1 AND device_id=$2`
 )
 
+// errTokenExpired is returned when a device token is valid, but has outlived its lifetime.
+var errTokenExpired = errors.New("device token expired")
+
+// tokenExpired determines whether a device token issued at the given time has outlived the configured lifetime.
+func tokenExpired(issued time.Time) bool {
+	lifetime := settings().DeviceTokenLifetime.Duration
+	return lifetime > 0 && now().Sub(issued) >= lifetime
+}
+
 // checkAuthentication validates various factors from a given request requiring authentication.
-func checkAuthentication(e *Envelope) (bool, error) {
+// Once the console is known to be who it claims, it also returns any ban applying to it.
+func checkAuthentication(e *Envelope) (bool, *Ban, error) {
 	// Get necessary authentication identifiers.
 	deviceToken, err := getKey(e.doc, "DeviceToken")
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 	accountId, err := e.AccountId()
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 
 	hash := validateTokenFormat(deviceToken)
 	if hash == "" {
-		return false, nil
+		return false, nil, nil
 	}
 
-	// Check using various input given.
-	row := pool.QueryRow(ctx, RouteVerifyStatement, hash, accountId, e.DeviceId())
-
-	var throwaway int
-	err = row.Scan(&throwaway)
-	if err == pgx.ErrNoRows {
-		return false, err
-	} else if err != nil {
-		// We shouldn't encounter other errors.
-		debugPrint("error occurred while checking authentication: %v\n", err)
-		return false, err
+	// Recently verified credentials, and their bans, need not be checked again.
+	deviceId := e.DeviceId()
+	issued, ban, ok := verifiedTokens.Lookup(deviceId, accountId, hash)
+	if ok {
+		authCacheResultsTotal.WithLabelValues("hit").Inc()
 	} else {
-		return true, nil
+		authCacheResultsTotal.WithLabelValues("miss").Inc()
+
+		var storedHash string
+		row := db.QueryRow(ctx, RouteVerifyStatement, accountId, deviceId)
+		err = row.Scan(&storedHash, &issued)
+		if err == pgx.ErrNoRows {
+			return false, nil, err
+		} else if err != nil {
+			// We shouldn't encounter other errors.
+			e.logger.Error("error occurred while checking authentication", "err", err)
+			return false, nil, err
+		}
+
+		// Hashes are compared here rather than within the query, so that this takes constant time.
+		if subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash)) != 1 {
+			return false, nil, nil
+		}
+
+		ban, err = findBan(ctx, deviceId, strconv.FormatInt(accountId, 10), "", "")
+		if err != nil {
+			e.logger.Error("error querying bans", "err", err)
+			return false, nil, err
+		}
+		verifiedTokens.Store(deviceId, accountId, hash, issued, ban)
+	}
+
+	if tokenExpired(issued) {
+		return false, ban, errTokenExpired
 	}
+	return true, ban, nil
 }
 
 // validateTokenFormat confirms the prefix and size of tokens,
@@ -195,7 +329,8 @@ func validateTokenFormat(token string) string {
 	}
 }
 
-func printError(w http.ResponseWriter, reason string) {
+// printError responds with the given reason as an error, logging it.
+func printError(w http.ResponseWriter, log *slog.Logger, reason string) {
 	http.Error(w, reason, http.StatusInternalServerError)
-	debugPrint("Failed to handle request: ", aurora.Red(reason))
+	log.Warn("failed to handle request", "reason", reason)
 }
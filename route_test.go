@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDebugLogsRedactTokens(t *testing.T) {
+	setupTestServer(t)
+	var logs bytes.Buffer
+	previousLogger := logger
+	logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() {
+		logger = previousLogger
+	})
+	handler := newServiceRoute()
+
+	tokens := regexp.MustCompile(`<DeviceToken>([^<]*)</DeviceToken>`)
+	for _, c := range []struct {
+		Service string
+		Action  string
+	}{
+		{"ecs", "CheckDeviceStatus"},
+		{"ias", "Register"},
+	} {
+		body, err := os.ReadFile(filepath.Join("testdata", "conformance", c.Service, c.Action+".request.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		handler.Handle().ServeHTTP(recorder, soapRequest(c.Service, c.Action, body))
+
+		// Both the token the console sent and any we issued must be absent.
+		secrets := []string{"WT-"}
+		for _, match := range tokens.FindAllStringSubmatch(recorder.Body.String(), -1) {
+			secrets = append(secrets, match[1])
+		}
+		for _, secret := range secrets {
+			if secret != "" && strings.Contains(logs.String(), secret) {
+				t.Errorf("%s logged device token %q", c.Action, secret)
+			}
+		}
+	}
+
+	if !strings.Contains(logs.String(), "REDACTED") {
+		t.Error("bodies were not logged with tokens redacted")
+	}
+}
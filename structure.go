@@ -20,6 +20,8 @@ package main
 import (
 	"encoding/xml"
 	"github.com/antchfx/xmlquery"
+	"log/slog"
+	"time"
 )
 
 /////////////////////
@@ -34,12 +36,140 @@ type Config struct {
 	Address string `xml:"Address"`
 	BaseURL string `xml:"BaseURL"`
 
+	// URLs returned within GetECConfig, derived from BaseURL if unset.
+	URLs ServiceURLs `xml:"URLs"`
+	// Overrides URLs for consoles within a region and/or country.
+	RegionURLs []RegionURLs `xml:"RegionURLs"`
+
+	// Optionally serves HTTPS alongside HTTP.
+	TLSAddress string `xml:"TLSAddress"`
+	TLSCert    string `xml:"TLSCert"`
+	TLSKey     string `xml:"TLSKey"`
+	TLSLegacy  bool   `xml:"TLSLegacy"`
+
 	SQLAddress string `xml:"SQLAddress"`
 	SQLUser    string `xml:"SQLUser"`
 	SQLPass    string `xml:"SQLPass"`
 	SQLDB      string `xml:"SQLDB"`
 
 	Debug bool `xml:"Debug"`
+
+	// Logs may be formatted as "text" or "json".
+	// Levels are "debug", "info", "warn" or "error", defaulting to debug if Debug is set.
+	LogFormat string `xml:"LogFormat"`
+	LogLevel  string `xml:"LogLevel"`
+
+	// Timeouts for the HTTP server, such as "30s".
+	ReadTimeout     Duration `xml:"ReadTimeout"`
+	WriteTimeout    Duration `xml:"WriteTimeout"`
+	IdleTimeout     Duration `xml:"IdleTimeout"`
+	ShutdownTimeout Duration `xml:"ShutdownTimeout"`
+
+	// How often to check the config file for changes, such as "5s", or 0 to only reload upon SIGHUP.
+	ReloadInterval Duration `xml:"ReloadInterval"`
+
+	// How long device tokens remain valid after being issued, such as "720h", or 0 for indefinitely.
+	DeviceTokenLifetime Duration `xml:"DeviceTokenLifetime"`
+
+	// How long verified credentials are cached, such as "30s", or 0 to always query the database.
+	// Changes made by other instances sharing a database apply once this elapses.
+	AuthCacheTTL Duration `xml:"AuthCacheTTL"`
+
+	// Limits how often clients may perform actions.
+	RateLimits RateLimits `xml:"RateLimits"`
+
+	// Issues challenges for consoles to return upon registering or synchronizing.
+	Challenges Challenges `xml:"Challenges"`
+
+	// Verifies certificates consoles present upon registering.
+	DeviceCertificates DeviceCertificates `xml:"DeviceCertificates"`
+
+	// AdminAddress serves metrics, health checks and the administrative API apart from consoles, or nothing if empty.
+	// AdminToken must be presented as a bearer token to use the administrative API, which is disabled if empty.
+	AdminAddress string `xml:"AdminAddress"`
+	AdminToken   string `xml:"AdminToken"`
+
+	// MaxRequestSize limits the size of request bodies, in bytes.
+	MaxRequestSize int64 `xml:"MaxRequestSize"`
+
+	// Optionally captures exchanges to rotating files within CaptureDir.
+	// If CaptureRedact is set, the comma-separated CaptureRedactElements are redacted.
+	CaptureDir            string `xml:"CaptureDir"`
+	CaptureMaxSize        int64  `xml:"CaptureMaxSize"`
+	CaptureMaxFiles       int    `xml:"CaptureMaxFiles"`
+	CaptureRedact         bool   `xml:"CaptureRedact"`
+	CaptureRedactElements string `xml:"CaptureRedactElements"`
+}
+
+// ServiceURLs describes where consoles should find each service and content.
+type ServiceURLs struct {
+	EcsURL string `xml:"EcsURL"`
+	IasURL string `xml:"IasURL"`
+	CasURL string `xml:"CasURL"`
+	NusURL string `xml:"NusURL"`
+
+	// Uncached prefixes default to their cached counterparts, and system prefixes to those for titles.
+	ContentPrefixURL               string `xml:"ContentPrefixURL"`
+	UncachedContentPrefixURL       string `xml:"UncachedContentPrefixURL"`
+	SystemContentPrefixURL         string `xml:"SystemContentPrefixURL"`
+	SystemUncachedContentPrefixURL string `xml:"SystemUncachedContentPrefixURL"`
+}
+
+// RegionURLs overrides URLs for consoles matching Region and Country, whichever are specified.
+type RegionURLs struct {
+	Region  string `xml:"Region,attr"`
+	Country string `xml:"Country,attr"`
+	ServiceURLs
+}
+
+// RateLimits describes token buckets applied per action to each client IP and authenticated DeviceId,
+// and temporary bans for client IPs repeatedly failing authentication.
+// As clients must be identified by their address, limits require TrustProxy or serving TLS directly.
+type RateLimits struct {
+	// Requests per second, and how many may be made at once. A rate of 0 disables limiting.
+	Rate    float64           `xml:"Rate"`
+	Burst   int               `xml:"Burst"`
+	Actions []ActionRateLimit `xml:"Action"`
+
+	// Client IPs failing authentication AuthFailures times within AuthFailureWindow are banned for BanDuration.
+	// An AuthFailures of 0 disables banning.
+	AuthFailures      int      `xml:"AuthFailures"`
+	AuthFailureWindow Duration `xml:"AuthFailureWindow"`
+	BanDuration       Duration `xml:"BanDuration"`
+
+	// TrustProxy identifies clients by X-Forwarded-For, which must only be set if behind a proxy.
+	TrustProxy bool `xml:"TrustProxy"`
+}
+
+// Challenges describes how GetChallenge issues challenges.
+type Challenges struct {
+	// Strict issues random challenges to each console, which must be returned to Register or SyncRegistration
+	// within Lifetime, signed if their device certificate is known. Otherwise, all consoles receive SharedChallenge
+	// and nothing is verified.
+	Strict   bool     `xml:"Strict"`
+	Lifetime Duration `xml:"Lifetime"`
+}
+
+// DeviceCertificates describes the MS, which issues the certificates of retail consoles.
+type DeviceCertificates struct {
+	// MSPublicKey is the MS's sect233r1 public key in hexadecimal, as within its certificate.
+	// Certificates are required and verified if set.
+	MSPublicKey string `xml:"MSPublicKey"`
+	// Issuer is the name certificates are issued by, such as Root-CA00000001-MS00000002.
+	Issuer string `xml:"Issuer"`
+}
+
+// ActionRateLimit overrides the rate and burst for an action, optionally only within a service.
+type ActionRateLimit struct {
+	Service string  `xml:"Service,attr"`
+	Action  string  `xml:"Name,attr"`
+	Rate    float64 `xml:"Rate,attr"`
+	Burst   int     `xml:"Burst,attr"`
+}
+
+// Duration allows specifying a time.Duration in configuration as a string, such as "1m30s".
+type Duration struct {
+	time.Duration
 }
 
 // Envelope represents the root element of any response, soapenv:Envelope.
@@ -53,7 +183,11 @@ type Envelope struct {
 	Body Body
 
 	// Used for internal state tracking.
-	doc *xmlquery.Node
+	doc    *xmlquery.Node
+	logger *slog.Logger
+
+	// Common response values, copied into the action's response upon Respond.
+	common Response
 
 	// Common IAS values.
 	region   string
@@ -67,10 +201,16 @@ type Body struct {
 	XMLName string `xml:"soapenv:Body"`
 
 	// Represents the actual response inside
-	Response Response
+	Response Responder
+}
+
+// Responder is implemented by all action responses through embedding Response.
+type Responder interface {
+	common() *Response
 }
 
 // Response describes the inner response format, along with common fields across requests.
+// Action-specific responses embed this type, followed by their own fields in the order Nintendo sent them.
 type Response struct {
 	XMLName xml.Name
 	XMLNS   string `xml:"xmlns,attr"`
@@ -82,15 +222,17 @@ type Response struct {
 	TimeStamp          string `xml:"TimeStamp"`
 	ErrorCode          int
 	ServiceStandbyMode bool `xml:"ServiceStandbyMode"`
+}
 
-	// Allows for <name>[dynamic content]</name> situations.
-	CustomFields []interface{}
+func (r *Response) common() *Response {
+	return r
 }
 
-// KVField represents an individual node in form of <XMLName>Contents</XMLName>.
-type KVField struct {
-	XMLName xml.Name
-	Value   string `xml:",chardata"`
+// ErrorResponse is sent in place of an action's usual response upon failure.
+type ErrorResponse struct {
+	Response
+	UserReason   string `xml:"UserReason"`
+	ServerReason string `xml:"ServerReason"`
 }
 
 // Balance represents a common XML structure.
@@ -100,6 +242,12 @@ type Balance struct {
 	Currency string   `xml:"Currency"`
 }
 
+// Price represents the cost of an item, as sent by the console.
+type Price struct {
+	Amount   int    `xml:"Amount"`
+	Currency string `xml:"Currency"`
+}
+
 type LimitKinds int
 
 const (
@@ -163,3 +311,223 @@ type Tickets struct {
 	MigrateCount int      `xml:"MigrateCount"`
 	MigrateLimit int      `xml:"MigrateLimit"`
 }
+
+// Request describes fields common across all requests.
+// Action-specific requests embed this type, followed by their own fields.
+type Request struct {
+	XMLName xml.Name
+
+	Version   string `xml:"Version"`
+	MessageId string `xml:"MessageId"`
+	DeviceId  int    `xml:"DeviceId"`
+	Region    string `xml:"Region"`
+	Country   string `xml:"Country"`
+	Language  string `xml:"Language"`
+}
+
+// AuthenticatedRequest describes fields common across all requests requiring authentication.
+type AuthenticatedRequest struct {
+	Request
+	AccountId   int64  `xml:"AccountId"`
+	DeviceToken string `xml:"DeviceToken"`
+}
+
+func (r *Request) common() *Request {
+	return r
+}
+
+func (r *AuthenticatedRequest) authentication() *AuthenticatedRequest {
+	return r
+}
+
+//////////////////
+// ECS REQUESTS //
+//////////////////
+
+// CheckDeviceStatusRequest is the request for ECS's CheckDeviceStatus.
+type CheckDeviceStatusRequest struct {
+	AuthenticatedRequest
+}
+
+// NotifyETicketsSyncedRequest is the request for ECS's NotifyETicketsSynced.
+type NotifyETicketsSyncedRequest struct {
+	AuthenticatedRequest
+}
+
+// ListETicketsRequest is the request for ECS's ListETickets.
+type ListETicketsRequest struct {
+	AuthenticatedRequest
+}
+
+// GetETicketsRequest is the request for ECS's GetETickets.
+type GetETicketsRequest struct {
+	AuthenticatedRequest
+}
+
+// PurchaseTitleRequest is the request for ECS's PurchaseTitle.
+type PurchaseTitleRequest struct {
+	AuthenticatedRequest
+	ItemId  int    `xml:"ItemId"`
+	TitleId string `xml:"TitleId"`
+	Price   Price  `xml:"Price"`
+}
+
+// ListPurchaseHistoryRequest is the request for ECS's ListPurchaseHistory.
+type ListPurchaseHistoryRequest struct {
+	AuthenticatedRequest
+}
+
+// GetECConfigRequest is the request for ECS's GetECConfig.
+type GetECConfigRequest struct {
+	Request
+}
+
+//////////////////
+// IAS REQUESTS //
+//////////////////
+
+// CheckRegistrationRequest is the request for IAS's CheckRegistration.
+type CheckRegistrationRequest struct {
+	Request
+	SerialNumber string `xml:"SerialNumber"`
+}
+
+// GetChallengeRequest is the request for IAS's GetChallenge.
+type GetChallengeRequest struct {
+	Request
+}
+
+// GetRegistrationInfoRequest is the request for IAS's GetRegistrationInfo.
+type GetRegistrationInfoRequest struct {
+	AuthenticatedRequest
+}
+
+// SyncRegistrationRequest is the request for IAS's SyncRegistration.
+type SyncRegistrationRequest struct {
+	Request
+	Challenge string `xml:"Challenge,omitempty"`
+	Signature string `xml:"Signature,omitempty"`
+}
+
+// RegisterRequest is the request for IAS's Register.
+type RegisterRequest struct {
+	Request
+	DeviceCode     string `xml:"DeviceCode"`
+	RegisterRegion string `xml:"RegisterRegion"`
+	SerialNumber   string `xml:"SerialNumber"`
+	DeviceCert     string `xml:"DeviceCert,omitempty"`
+	Challenge      string `xml:"Challenge,omitempty"`
+	Signature      string `xml:"Signature,omitempty"`
+}
+
+// UnregisterRequest is the request for IAS's Unregister.
+type UnregisterRequest struct {
+	AuthenticatedRequest
+}
+
+///////////////////
+// ECS RESPONSES //
+///////////////////
+
+// CheckDeviceStatusResponse is the response to ECS's CheckDeviceStatus.
+type CheckDeviceStatusResponse struct {
+	Response
+	Balance       Balance `xml:"Balance"`
+	ForceSyncTime string  `xml:"ForceSyncTime"`
+	ExtTicketTime string  `xml:"ExtTicketTime"`
+	SyncTime      string  `xml:"SyncTime"`
+}
+
+// ListETicketsResponse is the response to ECS's ListETickets.
+type ListETicketsResponse struct {
+	Response
+	Tickets       []Tickets `xml:"Tickets"`
+	ForceSyncTime string    `xml:"ForceSyncTime"`
+	ExtTicketTime string    `xml:"ExtTicketTime"`
+	SyncTime      string    `xml:"SyncTime"`
+}
+
+// GetETicketsResponse is the response to ECS's GetETickets.
+type GetETicketsResponse struct {
+	Response
+	ForceSyncTime string `xml:"ForceSyncTime"`
+	ExtTicketTime string `xml:"ExtTicketTime"`
+	SyncTime      string `xml:"SyncTime"`
+}
+
+// PurchaseTitleResponse is the response to ECS's PurchaseTitle.
+type PurchaseTitleResponse struct {
+	Response
+	Balance      Balance      `xml:"Balance"`
+	Transactions Transactions `xml:"Transactions"`
+	SyncTime     string       `xml:"SyncTime"`
+	Certs        string       `xml:"Certs"`
+	TitleId      string       `xml:"TitleId"`
+	ETickets     string       `xml:"ETickets"`
+}
+
+// ListPurchaseHistoryResponse is the response to ECS's ListPurchaseHistory.
+type ListPurchaseHistoryResponse struct {
+	Response
+	Transactions        []Transactions `xml:"Transactions"`
+	ListResultTotalSize int            `xml:"ListResultTotalSize"`
+}
+
+// GetECConfigResponse is the response to ECS's GetECConfig.
+type GetECConfigResponse struct {
+	Response
+	ContentPrefixURL               string `xml:"ContentPrefixURL"`
+	UncachedContentPrefixURL       string `xml:"UncachedContentPrefixURL"`
+	SystemContentPrefixURL         string `xml:"SystemContentPrefixURL"`
+	SystemUncachedContentPrefixURL string `xml:"SystemUncachedContentPrefixURL"`
+	EcsURL                         string `xml:"EcsURL"`
+	IasURL                         string `xml:"IasURL"`
+	CasURL                         string `xml:"CasURL"`
+	NusURL                         string `xml:"NusURL"`
+}
+
+///////////////////
+// IAS RESPONSES //
+///////////////////
+
+// CheckRegistrationResponse is the response to IAS's CheckRegistration.
+type CheckRegistrationResponse struct {
+	Response
+	OriginalSerialNumber string `xml:"OriginalSerialNumber"`
+	DeviceStatus         string `xml:"DeviceStatus"`
+}
+
+// GetChallengeResponse is the response to IAS's GetChallenge.
+type GetChallengeResponse struct {
+	Response
+	Challenge string `xml:"Challenge"`
+}
+
+// SyncRegistrationResponse is the response to IAS's SyncRegistration.
+type SyncRegistrationResponse struct {
+	Response
+	AccountId          int64  `xml:"AccountId"`
+	DeviceToken        string `xml:"DeviceToken"`
+	DeviceTokenExpired bool   `xml:"DeviceTokenExpired"`
+	Country            string `xml:"Country"`
+	ExtAccountId       string `xml:"ExtAccountId"`
+	DeviceStatus       string `xml:"DeviceStatus"`
+}
+
+// GetRegistrationInfoResponse is the response to IAS's GetRegistrationInfo.
+// It is SyncRegistration's response with an additional key.
+type GetRegistrationInfoResponse struct {
+	SyncRegistrationResponse
+	Currency string `xml:"Currency"`
+}
+
+// RegisterResponse is the response to IAS's Register.
+type RegisterResponse struct {
+	Response
+	AccountId          int64  `xml:"AccountId"`
+	DeviceToken        string `xml:"DeviceToken"`
+	DeviceTokenExpired bool   `xml:"DeviceTokenExpired"`
+	Country            string `xml:"Country"`
+	ExtAccountId       string `xml:"ExtAccountId"`
+	DeviceCode         string `xml:"DeviceCode"`
+}
@@ -18,19 +18,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/antchfx/xmlquery"
 	"io"
-	"log"
-	"math/rand"
+	"io/ioutil"
+	"math/big"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 )
 
+// now returns the current time, and may be replaced to produce consistent output.
+var now = time.Now
+
 var namespaceParse = regexp.MustCompile(`^urn:(.{3})\.wsapi\.broadon\.com/(.*)$`)
 
 // parseAction interprets contents along the lines of "urn:ecs.wsapi.broadon.com/CheckDeviceStatus",
@@ -51,10 +55,10 @@ func parseAction(original string) (string, string) {
 // NewEnvelope returns a new Envelope with proper attributes initialized.
 func NewEnvelope(service string, action string, body []byte) (*Envelope, error) {
 	// Get a sexy new timestamp to use.
-	timestampNano := fmt.Sprint(time.Now().UTC().UnixNano())[0:13]
+	timestampNano := fmt.Sprint(now().UTC().UnixNano())[0:13]
 
 	// Tidy up parsed document for easier usage going forward.
-	doc, err := normalise(service, action, strings.NewReader(string(body)))
+	doc, err := normalise(service, action, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -64,15 +68,14 @@ func NewEnvelope(service string, action string, body []byte) (*Envelope, error)
 		SOAPEnv: "http://schemas.xmlsoap.org/soap/envelope/",
 		XSD:     "http://www.w3.org/2001/XMLSchema",
 		XSI:     "http://www.w3.org/2001/XMLSchema-instance",
-		Body: Body{
-			Response: Response{
-				XMLName: xml.Name{Local: action + "Response"},
-				XMLNS:   "urn:" + service + ".wsapi.broadon.com",
+		common: Response{
+			XMLName: xml.Name{Local: action + "Response"},
+			XMLNS:   "urn:" + service + ".wsapi.broadon.com",
 
-				TimeStamp: timestampNano,
-			},
+			TimeStamp: timestampNano,
 		},
-		doc: doc,
+		doc:    doc,
+		logger: logger,
 	}
 
 	// Obtain common request values.
@@ -81,17 +84,20 @@ func NewEnvelope(service string, action string, body []byte) (*Envelope, error)
 		return nil, err
 	}
 
+	// Actions without a response of their own reply with only common fields.
+	e.Respond(&Response{})
+
 	return &e, nil
 }
 
 // Timestamp returns a shared timestamp for this request.
 func (e *Envelope) Timestamp() string {
-	return e.Body.Response.TimeStamp
+	return e.common.TimeStamp
 }
 
 // DeviceId returns the Device ID for this request.
 func (e *Envelope) DeviceId() int {
-	return e.Body.Response.DeviceId
+	return e.common.DeviceId
 }
 
 // Region returns the region for this request. It should be only used in IAS-related requests.
@@ -127,7 +133,7 @@ func (e *Envelope) ObtainCommon() error {
 	doc := e.doc
 
 	// These fields are common across all requests.
-	e.Body.Response.Version, err = getKey(doc, "Version")
+	e.common.Version, err = getKey(doc, "Version")
 	if err != nil {
 		return err
 	}
@@ -135,11 +141,11 @@ func (e *Envelope) ObtainCommon() error {
 	if err != nil {
 		return err
 	}
-	e.Body.Response.DeviceId, err = strconv.Atoi(deviceIdString)
+	e.common.DeviceId, err = strconv.Atoi(deviceIdString)
 	if err != nil {
 		return err
 	}
-	e.Body.Response.MessageId, err = getKey(doc, "MessageId")
+	e.common.MessageId, err = getKey(doc, "MessageId")
 	if err != nil {
 		return err
 	}
@@ -161,30 +167,38 @@ func (e *Envelope) ObtainCommon() error {
 	return nil
 }
 
-// AddKVNode adds a given key by name to a specified value, such as <key>value</key>.
-func (e *Envelope) AddKVNode(key string, value string) {
-	e.Body.Response.CustomFields = append(e.Body.Response.CustomFields, KVField{
-		XMLName: xml.Name{Local: key},
-		Value:   value,
-	})
+// Respond sets the given response as this action's response, filling in common fields.
+func (e *Envelope) Respond(response Responder) {
+	*response.common() = e.common
+	e.Body.Response = response
 }
 
-// AddCustomType adds a given key by name to a specified structure.
-func (e *Envelope) AddCustomType(customType interface{}) {
-	e.Body.Response.CustomFields = append(e.Body.Response.CustomFields, customType)
+// MarshalXML encodes the response within, named after its action.
+// encoding/xml does not observe the XMLName of embedded structures, so we must specify it ourselves.
+func (b Body) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	err := encoder.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	err = encoder.EncodeElement(b.Response, xml.StartElement{Name: b.Response.common().XMLName})
+	if err != nil {
+		return err
+	}
+
+	return encoder.EncodeToken(start.End())
 }
 
 // becomeXML marshals the Envelope object, returning the intended boolean state on success.
-// ..there has to be a better way to do this, TODO.
 func (e *Envelope) becomeXML() (bool, string) {
 	// Non-zero error codes indicate a failure.
-	intendedStatus := e.Body.Response.ErrorCode == 0
+	intendedStatus := e.Body.Response.common().ErrorCode == 0
 
 	var contents []byte
 	var err error
 
 	// If we're in debug mode, pretty print XML.
-	if isDebug {
+	if settings().Debug {
 		contents, err = xml.MarshalIndent(e, "", "  ")
 	} else {
 		contents, err = xml.Marshal(e)
@@ -199,27 +213,100 @@ func (e *Envelope) becomeXML() (bool, string) {
 	}
 }
 
-// Error sets the necessary keys for this SOAP response to reflect the given error.
+// Error replaces this action's response with one reflecting the given error.
 func (e *Envelope) Error(errorCode int, reason string, err error) {
-	e.Body.Response.ErrorCode = errorCode
+	response := &ErrorResponse{
+		UserReason:   reason,
+		ServerReason: err.Error(),
+	}
+	e.Respond(response)
+	response.ErrorCode = errorCode
+}
+
+const (
+	// DefaultMaxRequestSize is the default limit for request bodies, in bytes.
+	// Requests from the Wii are typically no larger than a few kilobytes.
+	DefaultMaxRequestSize = 64 * 1024
+
+	// maxElementDepth limits nesting within documents. soapenv:Envelope is at a depth of 1,
+	// and no known request nests further than 5.
+	maxElementDepth = 16
 
-	// Ensure all additional fields are empty to avoid conflict.
-	e.Body.Response.CustomFields = nil
+	// maxElements limits the amount of elements within a document.
+	maxElements = 1024
 
-	e.AddKVNode("UserReason", reason)
-	e.AddKVNode("ServerReason", err.Error())
+	// SOAPEnvelopeNamespace is the namespace for SOAP 1.1 envelopes.
+	SOAPEnvelopeNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+)
+
+// validateDocument ensures a document is not excessively nested or large, and declares no DTD.
+// SOAP messages must not contain a DTD, so we do not permit any entity declarations.
+func validateDocument(document []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	depth := 0
+	elements := 0
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch token.(type) {
+		case xml.StartElement:
+			depth++
+			elements++
+			if depth > maxElementDepth {
+				return errors.New("document is nested too deeply")
+			}
+			if elements > maxElements {
+				return errors.New("document contains too many elements")
+			}
+		case xml.EndElement:
+			depth--
+		case xml.Directive:
+			return errors.New("document type declarations are not permitted")
+		}
+	}
 }
 
 // normalise parses a document, returning a document with only the request type's child nodes, stripped of prefix.
+// The document must be a SOAP envelope whose body contains the given action.
 func normalise(service string, action string, reader io.Reader) (*xmlquery.Node, error) {
-	doc, err := xmlquery.Parse(reader)
+	document, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateDocument(document)
 	if err != nil {
 		return nil, err
 	}
 
+	doc, err := xmlquery.Parse(bytes.NewReader(document))
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := firstElement(doc)
+	if envelope == nil || envelope.Data != "Envelope" || envelope.NamespaceURI != SOAPEnvelopeNamespace {
+		return nil, errors.New("root node is not a SOAP envelope")
+	}
+
+	// soapenv:Header may precede soapenv:Body.
+	body := firstElement(envelope)
+	if body != nil && body.Data == "Header" && body.NamespaceURI == SOAPEnvelopeNamespace {
+		body = nextElement(body)
+	}
+	if body == nil || body.Data != "Body" || body.NamespaceURI != SOAPEnvelopeNamespace {
+		return nil, errors.New("missing SOAP body")
+	}
+
 	// Find the keys for this element named after the action.
-	result := doc.SelectElement("//" + service + ":" + action)
-	if result == nil {
+	result := firstElement(body)
+	if result == nil || result.Data != action || result.NamespaceURI != "urn:"+service+".wsapi.broadon.com" {
 		return nil, errors.New("missing root node")
 	}
 	stripNamespace(result)
@@ -227,6 +314,28 @@ func normalise(service string, action string, reader io.Reader) (*xmlquery.Node,
 	return result, nil
 }
 
+// firstElement returns the first child element of a node, or nil if there is none.
+func firstElement(node *xmlquery.Node) *xmlquery.Node {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == xmlquery.ElementNode {
+			return child
+		}
+	}
+
+	return nil
+}
+
+// nextElement returns the next sibling element of a node, or nil if there is none.
+func nextElement(node *xmlquery.Node) *xmlquery.Node {
+	for sibling := node.NextSibling; sibling != nil; sibling = sibling.NextSibling {
+		if sibling.Type == xmlquery.ElementNode {
+			return sibling
+		}
+	}
+
+	return nil
+}
+
 // stripNamespace removes a prefix from nodes, changing a key from "ias:Version" to "Version".
 // It is based off of https://github.com/antchfx/xmlquery/issues/15#issuecomment-567575075.
 func stripNamespace(node *xmlquery.Node) {
@@ -239,7 +348,7 @@ func stripNamespace(node *xmlquery.Node) {
 
 // getKey returns the value for a child key from a node, if documented.
 func getKey(doc *xmlquery.Node, key string) (string, error) {
-	node := xmlquery.FindOne(doc, "//"+key)
+	node := findElement(doc, key)
 
 	if node == nil {
 		return "", errors.New("missing mandatory key named " + key)
@@ -248,21 +357,53 @@ func getKey(doc *xmlquery.Node, key string) (string, error) {
 	}
 }
 
+// findElement returns the first element with the given name, searching depth-first from and including node.
+func findElement(node *xmlquery.Node, name string) *xmlquery.Node {
+	if node.Type == xmlquery.ElementNode && node.Data == name {
+		return node
+	}
+
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findElement(child, name); found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
 // Derived from https://stackoverflow.com/a/31832326, adding numbers
 const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-func RandString(n int) string {
+// RandString returns n characters chosen uniformly from letterBytes, suitable for use as a secret.
+func RandString(n int) (string, error) {
 	b := make([]byte, n)
 	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		index, err := RandInt63n(int64(len(letterBytes)))
+		if err != nil {
+			return "", err
+		}
+		b[i] = letterBytes[index]
 	}
-	return string(b)
+	return string(b), nil
 }
 
-func debugPrint(v ...interface{}) {
-	if !isDebug {
-		return
+// RandInt63n returns a cryptographically secure random number in [0, n).
+func RandInt63n(n int64) (int64, error) {
+	value, err := rand.Int(rand.Reader, big.NewInt(n))
+	if err != nil {
+		return 0, err
 	}
+	return value.Int64(), nil
+}
 
-	log.Print(v...)
+// UnmarshalText parses a duration such as "1m30s".
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
 }
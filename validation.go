@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+const (
+	// Error codes reported upon rejecting a registration no real console could have made.
+	InvalidSerialNumberErrorCode      = 924
+	InvalidDeviceIdErrorCode          = 925
+	InvalidLocaleErrorCode            = 926
+	InvalidDeviceCertificateErrorCode = 927
+
+	// Device IDs of Wii consoles hold this platform within their upper 32 bits,
+	// and the console's Hollywood ID within their lower 32 bits.
+	WiiPlatformId = 1
+
+	// Hollywood IDs assigned to consoles lie within this range. The Hollywood ID is the NG ID
+	// programmed into each console's OTP, as described by WiiBrew's Hardware/OTP page.
+	MinimumHollywoodId = 0x04000000
+	MaximumHollywoodId = 0x0fffffff
+)
+
+// serialNumberFormat matches serial numbers as printed on consoles, such as LU521023236 or LEH123456784.
+// Their letters describe the console's model and region, followed by eight digits and a check digit.
+var serialNumberFormat = regexp.MustCompile(`^[A-Z]{2,3}([0-9]{8})([0-9])$`)
+
+// regionLocales lists the countries and languages consoles of each region may be set to.
+var regionLocales = map[string]struct {
+	Countries []string
+	Languages []string
+}{
+	"JPN": {
+		Countries: []string{"JP"},
+		Languages: []string{"ja"},
+	},
+	"USA": {
+		Countries: []string{
+			"AG", "AI", "AR", "AW", "BB", "BM", "BO", "BR", "BS", "BZ", "CA", "CL", "CO", "CR", "DM", "DO", "EC",
+			"GD", "GF", "GP", "GT", "GY", "HN", "HT", "JM", "KN", "KY", "LC", "MQ", "MS", "MX", "NI", "PA", "PE",
+			"PY", "SR", "SV", "TC", "TT", "US", "UY", "VC", "VE", "VG", "VI",
+		},
+		Languages: []string{"en", "fr", "es"},
+	},
+	"EUR": {
+		Countries: []string{
+			"AD", "AT", "AU", "BA", "BE", "BG", "BW", "CH", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GB",
+			"GG", "GR", "HR", "HU", "IE", "IM", "IS", "IT", "JE", "LI", "LS", "LT", "LU", "LV", "MC", "ME", "MK",
+			"MT", "MZ", "NA", "NL", "NO", "NZ", "PL", "PT", "RO", "RS", "SE", "SI", "SK", "SM", "SZ", "TR", "VA",
+			"ZA", "ZM", "ZW",
+		},
+		Languages: []string{"en", "de", "fr", "es", "it", "nl"},
+	},
+	"KOR": {
+		Countries: []string{"KR"},
+		Languages: []string{"ko", "en"},
+	},
+	"TWN": {
+		Countries: []string{"TW", "HK"},
+		Languages: []string{"zh", "en"},
+	},
+}
+
+// serialCheckDigit returns the check digit for the eight digits of a serial number.
+// Digits are weighted by 3 and 1 alternately from the rightmost, following the standard check digit
+// calculation of the GS1 General Specifications (section 7.9) as used within the barcodes on console labels.
+func serialCheckDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i -= 2 {
+		sum += 3 * int(digits[i]-'0')
+		if i > 0 {
+			sum += int(digits[i-1] - '0')
+		}
+	}
+
+	return byte('0' + (10-sum%10)%10)
+}
+
+// validateSerialNumber ensures a serial number is of the format consoles have, with a correct check digit.
+func validateSerialNumber(serialNumber string) error {
+	match := serialNumberFormat.FindStringSubmatch(serialNumber)
+	if match == nil {
+		return errors.New("serial number is not of a console's format")
+	}
+	if serialCheckDigit(match[1]) != match[2][0] {
+		return errors.New("serial number has an incorrect check digit")
+	}
+
+	return nil
+}
+
+// validateDeviceId ensures a device ID is within the range of those Wii consoles have.
+func validateDeviceId(deviceId int) error {
+	platform := deviceId >> 32
+	hollywoodId := deviceId & 0xffffffff
+	if platform != WiiPlatformId {
+		return fmt.Errorf("device ID is not of a Wii, but platform %d", platform)
+	}
+	if hollywoodId < MinimumHollywoodId || hollywoodId > MaximumHollywoodId {
+		return fmt.Errorf("Hollywood ID %08x is outside the range consoles use", hollywoodId)
+	}
+
+	return nil
+}
+
+// validateLocale ensures a console of the given region could be set to the given country and language.
+func validateLocale(region string, country string, language string) error {
+	locales, ok := regionLocales[region]
+	if !ok {
+		return fmt.Errorf("unknown region %q", region)
+	}
+	if !slices.Contains(locales.Countries, country) {
+		return fmt.Errorf("country %q is not available to region %s", country, region)
+	}
+	if !slices.Contains(locales.Languages, language) {
+		return fmt.Errorf("language %q is not available to region %s", language, region)
+	}
+
+	return nil
+}
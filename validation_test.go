@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateSerialNumber(t *testing.T) {
+	cases := []struct {
+		Name         string
+		SerialNumber string
+		Valid        bool
+	}{
+		{"two letters", "LU521023236", true},
+		{"three letters", "LEH123456784", true},
+		{"zero check digit", "LU000000000", true},
+		{"incorrect check digit", "LU521023237", false},
+		{"one letter", "L521023236", false},
+		{"four letters", "LUEH12345678", false},
+		{"lowercase", "lu521023236", false},
+		{"too few digits", "LU52102323", false},
+		{"too many digits", "LU5210232366", false},
+		{"trailing newline", "LU521023236\n", false},
+		{"empty", "", false},
+	}
+	for _, c := range cases {
+		if err := validateSerialNumber(c.SerialNumber); (err == nil) != c.Valid {
+			t.Errorf("%s: %q gave %v", c.Name, c.SerialNumber, err)
+		}
+	}
+}
+
+func TestValidateDeviceId(t *testing.T) {
+	cases := []struct {
+		Name     string
+		DeviceId int
+		Valid    bool
+	}{
+		{"test console", testDeviceId, true},
+		{"minimum", WiiPlatformId<<32 | MinimumHollywoodId, true},
+		{"maximum", WiiPlatformId<<32 | MaximumHollywoodId, true},
+		{"below minimum", WiiPlatformId<<32 | (MinimumHollywoodId - 1), false},
+		{"above maximum", WiiPlatformId<<32 | (MaximumHollywoodId + 1), false},
+		{"no platform", MinimumHollywoodId, false},
+		{"other platform", 2<<32 | MinimumHollywoodId, false},
+		{"zero", 0, false},
+	}
+	for _, c := range cases {
+		if err := validateDeviceId(c.DeviceId); (err == nil) != c.Valid {
+			t.Errorf("%s: %x gave %v", c.Name, c.DeviceId, err)
+		}
+	}
+}
+
+func TestValidateLocale(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Region   string
+		Country  string
+		Language string
+		Valid    bool
+	}{
+		{"USA", "USA", "US", "en", true},
+		{"Canadian French", "USA", "CA", "fr", true},
+		{"JPN", "JPN", "JP", "ja", true},
+		{"EUR", "EUR", "DE", "de", true},
+		{"KOR", "KOR", "KR", "ko", true},
+		{"TWN", "TWN", "HK", "zh", true},
+		{"unknown region", "CHN", "CN", "zh", false},
+		{"country of another region", "USA", "JP", "en", false},
+		{"language of another region", "JPN", "JP", "en", false},
+		{"lowercase", "usa", "us", "en", false},
+	}
+	for _, c := range cases {
+		if err := validateLocale(c.Region, c.Country, c.Language); (err == nil) != c.Valid {
+			t.Errorf("%s: %s/%s/%s gave %v", c.Name, c.Region, c.Country, c.Language, err)
+		}
+	}
+
+	// Every region must list the locales of at least one console.
+	for region, locales := range regionLocales {
+		if len(locales.Countries) == 0 || len(locales.Languages) == 0 {
+			t.Errorf("region %s lists no countries or languages", region)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// WSDLDefinitions represents the root element of a WSDL document, wsdl:definitions.
+type WSDLDefinitions struct {
+	XMLName         string `xml:"wsdl:definitions"`
+	Name            string `xml:"name,attr"`
+	TargetNamespace string `xml:"targetNamespace,attr"`
+	WSDL            string `xml:"xmlns:wsdl,attr"`
+	SOAP            string `xml:"xmlns:soap,attr"`
+	XSD             string `xml:"xmlns:xsd,attr"`
+	TNS             string `xml:"xmlns:tns,attr"`
+
+	Types    WSDLTypes
+	Messages []WSDLMessage `xml:"wsdl:message"`
+	PortType WSDLPortType
+	Binding  WSDLBinding
+	Service  WSDLService
+}
+
+// WSDLTypes contains the schema describing all messages for a service.
+type WSDLTypes struct {
+	XMLName string `xml:"wsdl:types"`
+	Schema  XSDSchema
+}
+
+// XSDSchema represents the schema for a service's requests and responses.
+type XSDSchema struct {
+	XMLName            string           `xml:"xsd:schema"`
+	TargetNamespace    string           `xml:"targetNamespace,attr"`
+	ElementFormDefault string           `xml:"elementFormDefault,attr"`
+	Elements           []XSDElement     `xml:"xsd:element"`
+	ComplexTypes       []XSDComplexType `xml:"xsd:complexType"`
+}
+
+// XSDElement represents an individual element within a schema.
+type XSDElement struct {
+	Name      string `xml:"name,attr"`
+	Type      string `xml:"type,attr"`
+	MinOccurs string `xml:"minOccurs,attr,omitempty"`
+	MaxOccurs string `xml:"maxOccurs,attr,omitempty"`
+}
+
+// XSDComplexType represents a sequence of elements, derived from a structure.
+type XSDComplexType struct {
+	Name     string `xml:"name,attr"`
+	Sequence struct {
+		Elements []XSDElement `xml:"xsd:element"`
+	} `xml:"xsd:sequence"`
+}
+
+// WSDLMessage represents a request or response message, referring to its element within the schema.
+type WSDLMessage struct {
+	Name string `xml:"name,attr"`
+	Part struct {
+		Name    string `xml:"name,attr"`
+		Element string `xml:"element,attr"`
+	} `xml:"wsdl:part"`
+}
+
+// WSDLPortType lists all operations available for a service.
+type WSDLPortType struct {
+	XMLName    string              `xml:"wsdl:portType"`
+	Name       string              `xml:"name,attr"`
+	Operations []WSDLPortOperation `xml:"wsdl:operation"`
+}
+
+// WSDLPortOperation associates an operation with its input and output messages.
+type WSDLPortOperation struct {
+	Name  string `xml:"name,attr"`
+	Input struct {
+		Message string `xml:"message,attr"`
+	} `xml:"wsdl:input"`
+	Output struct {
+		Message string `xml:"message,attr"`
+	} `xml:"wsdl:output"`
+}
+
+// WSDLBinding describes operations as document/literal SOAP over HTTP.
+type WSDLBinding struct {
+	XMLName     string `xml:"wsdl:binding"`
+	Name        string `xml:"name,attr"`
+	Type        string `xml:"type,attr"`
+	SOAPBinding struct {
+		Style     string `xml:"style,attr"`
+		Transport string `xml:"transport,attr"`
+	} `xml:"soap:binding"`
+	Operations []WSDLBindingOperation `xml:"wsdl:operation"`
+}
+
+// WSDLBindingOperation associates an operation with its SOAPAction.
+type WSDLBindingOperation struct {
+	Name          string `xml:"name,attr"`
+	SOAPOperation struct {
+		SOAPAction string `xml:"soapAction,attr"`
+	} `xml:"soap:operation"`
+	Input  WSDLBody `xml:"wsdl:input"`
+	Output WSDLBody `xml:"wsdl:output"`
+}
+
+// WSDLBody specifies how a message is represented within soapenv:Body.
+type WSDLBody struct {
+	Body struct {
+		Use string `xml:"use,attr"`
+	} `xml:"soap:body"`
+}
+
+// WSDLService specifies where a service can be reached.
+type WSDLService struct {
+	XMLName string `xml:"wsdl:service"`
+	Name    string `xml:"name,attr"`
+	Port    struct {
+		Name    string `xml:"name,attr"`
+		Binding string `xml:"binding,attr"`
+		Address struct {
+			Location string `xml:"location,attr"`
+		} `xml:"soap:address"`
+	} `xml:"wsdl:port"`
+}
+
+// WSDL generates a service description for all actions registered under the given service type.
+func (route *Route) WSDL(service string) WSDLDefinitions {
+	name := services[service]
+	namespace := "urn:" + service + ".wsapi.broadon.com"
+
+	definitions := WSDLDefinitions{
+		Name:            name,
+		TargetNamespace: namespace,
+		WSDL:            "http://schemas.xmlsoap.org/wsdl/",
+		SOAP:            "http://schemas.xmlsoap.org/wsdl/soap/",
+		XSD:             "http://www.w3.org/2001/XMLSchema",
+		TNS:             namespace,
+	}
+	definitions.Types.Schema = XSDSchema{
+		TargetNamespace:    namespace,
+		ElementFormDefault: "qualified",
+	}
+	definitions.PortType.Name = name + "PortType"
+	definitions.Binding.Name = name + "SOAPBinding"
+	definitions.Binding.Type = "tns:" + definitions.PortType.Name
+	definitions.Binding.SOAPBinding.Style = "document"
+	definitions.Binding.SOAPBinding.Transport = "http://schemas.xmlsoap.org/soap/http"
+	definitions.Service.Name = name + "Service"
+	definitions.Service.Port.Name = name + "SOAP"
+	definitions.Service.Port.Binding = "tns:" + definitions.Binding.Name
+	definitions.Service.Port.Address.Location = settings().ServiceURLs("", "").ForService(service)
+
+	schema := schemaBuilder{
+		schema: &definitions.Types.Schema,
+		seen:   map[string]bool{},
+	}
+
+	for _, action := range route.Actions {
+		if action.ServiceType != service {
+			continue
+		}
+
+		requestName := action.ActionName
+		responseName := action.ActionName + "Response"
+		schema.addElement(requestName, reflect.TypeOf(action.Request))
+		schema.addElement(responseName, reflect.TypeOf(action.Response))
+
+		for _, message := range []string{requestName, responseName} {
+			var wsdlMessage WSDLMessage
+			wsdlMessage.Name = message
+			wsdlMessage.Part.Name = "parameters"
+			wsdlMessage.Part.Element = "tns:" + message
+			definitions.Messages = append(definitions.Messages, wsdlMessage)
+		}
+
+		var portOperation WSDLPortOperation
+		portOperation.Name = action.ActionName
+		portOperation.Input.Message = "tns:" + requestName
+		portOperation.Output.Message = "tns:" + responseName
+		definitions.PortType.Operations = append(definitions.PortType.Operations, portOperation)
+
+		var bindingOperation WSDLBindingOperation
+		bindingOperation.Name = action.ActionName
+		bindingOperation.SOAPOperation.SOAPAction = namespace + "/" + action.ActionName
+		bindingOperation.Input.Body.Use = "literal"
+		bindingOperation.Output.Body.Use = "literal"
+		definitions.Binding.Operations = append(definitions.Binding.Operations, bindingOperation)
+	}
+
+	return definitions
+}
+
+// schemaBuilder derives schema types from the structures used to represent requests and responses.
+type schemaBuilder struct {
+	schema *XSDSchema
+	seen   map[string]bool
+}
+
+// addElement adds a top-level element of the given structure's type.
+func (b *schemaBuilder) addElement(name string, t reflect.Type) {
+	b.schema.Elements = append(b.schema.Elements, XSDElement{
+		Name: name,
+		Type: b.typeName(t),
+	})
+}
+
+// typeName returns the schema type for a Go type, adding complex types for structures as necessary.
+func (b *schemaBuilder) typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "xsd:boolean"
+	case reflect.Int32:
+		return "xsd:int"
+	case reflect.Int, reflect.Int64:
+		return "xsd:long"
+	case reflect.Struct:
+		name := t.Name()
+		if !b.seen[name] {
+			b.seen[name] = true
+
+			complexType := XSDComplexType{Name: name}
+			complexType.Sequence.Elements = b.elementsOf(t)
+			b.schema.ComplexTypes = append(b.schema.ComplexTypes, complexType)
+		}
+		return "tns:" + name
+	default:
+		return "xsd:string"
+	}
+}
+
+// elementsOf returns the elements a structure marshals into, in order.
+// Embedded structures have their elements flattened into the parent as encoding/xml does.
+func (b *schemaBuilder) elementsOf(t reflect.Type) []XSDElement {
+	var elements []XSDElement
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			elements = append(elements, b.elementsOf(field.Type)...)
+			continue
+		}
+		if field.Name == "XMLName" || field.PkgPath != "" {
+			continue
+		}
+
+		options := strings.Split(field.Tag.Get("xml"), ",")
+		name := options[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		element := XSDElement{Name: name}
+		isAttribute := false
+		for _, option := range options[1:] {
+			switch option {
+			case "attr":
+				isAttribute = true
+			case "omitempty":
+				element.MinOccurs = "0"
+			}
+		}
+		if isAttribute {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Slice {
+			element.MinOccurs = "0"
+			element.MaxOccurs = "unbounded"
+			fieldType = fieldType.Elem()
+		}
+		element.Type = b.typeName(fieldType)
+
+		elements = append(elements, element)
+	}
+
+	return elements
+}
+
+// isWSDLRequest determines whether a request is for a service description,
+// such as /ecs/services/ECommerceSOAP?wsdl.
+func isWSDLRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["wsdl"]
+	return ok
+}
+
+// hasActions determines whether any actions are registered under the given service type.
+func (route *Route) hasActions(service string) bool {
+	for _, action := range route.Actions {
+		if action.ServiceType == service {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serveWSDL writes the service description for the service named by the request's path.
+// Services we know of but implement no actions for have no description.
+func (route *Route) serveWSDL(w http.ResponseWriter, r *http.Request, log *slog.Logger) {
+	service := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+	if _, ok := services[service]; !ok {
+		printError(w, log, "Unsupported service type...")
+		return
+	}
+	if !route.hasActions(service) {
+		http.NotFound(w, r)
+		log.Debug("no actions to describe", "service", service)
+		return
+	}
+
+	contents, err := xml.MarshalIndent(route.WSDL(service), "", "  ")
+	if err != nil {
+		printError(w, log, "an error occurred marshalling WSDL: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write([]byte(xml.Header + string(contents)))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// parsedWSDL holds what a client would read from a service description, ignoring namespaces.
+type parsedWSDL struct {
+	Elements []struct {
+		Name string `xml:"name,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"types>schema>element"`
+	ComplexTypes []struct {
+		Name string `xml:"name,attr"`
+	} `xml:"types>schema>complexType"`
+	Operations []struct {
+		Name  string `xml:"name,attr"`
+		Input struct {
+			Message string `xml:"message,attr"`
+		} `xml:"input"`
+		Output struct {
+			Message string `xml:"message,attr"`
+		} `xml:"output"`
+	} `xml:"portType>operation"`
+	Bindings []struct {
+		Name       string `xml:"name,attr"`
+		SOAPAction struct {
+			Value string `xml:"soapAction,attr"`
+		} `xml:"operation"`
+	} `xml:"binding>operation"`
+	Location struct {
+		Value string `xml:"location,attr"`
+	} `xml:"service>port>address"`
+}
+
+func TestWSDL(t *testing.T) {
+	setupTestServer(t)
+	route := newServiceRoute()
+	handler := route.Handle()
+
+	for _, service := range []string{"ecs", "ias"} {
+		t.Run(service, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/"+service+"/services/"+services[service]+"SOAP?wsdl", nil))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", recorder.Code, recorder.Body.String())
+			}
+
+			var wsdl parsedWSDL
+			err := xml.Unmarshal(recorder.Body.Bytes(), &wsdl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wsdl.Location.Value != "http://"+service+".example.com/"+service+"/services/"+services[service]+"SOAP" {
+				t.Errorf("service is located at %q", wsdl.Location.Value)
+			}
+
+			elements := map[string]string{}
+			for _, element := range wsdl.Elements {
+				elements[element.Name] = element.Type
+			}
+			complexTypes := map[string]bool{}
+			for _, complexType := range wsdl.ComplexTypes {
+				complexTypes["tns:"+complexType.Name] = true
+			}
+			operations := map[string]string{}
+			for _, operation := range wsdl.Operations {
+				operations[operation.Name] = operation.Input.Message + " " + operation.Output.Message
+			}
+			bindings := map[string]string{}
+			for _, binding := range wsdl.Bindings {
+				bindings[binding.Name] = binding.SOAPAction.Value
+			}
+
+			described := 0
+			for _, action := range route.Actions {
+				if action.ServiceType != service {
+					continue
+				}
+				described++
+
+				name := action.ActionName
+				for _, element := range []string{name, name + "Response"} {
+					if !complexTypes[elements[element]] {
+						t.Errorf("%s has no element of a described type, but %q", element, elements[element])
+					}
+				}
+				if messages := operations[name]; messages != "tns:"+name+" tns:"+name+"Response" {
+					t.Errorf("%s is an operation with messages %q", name, messages)
+				}
+				if soapAction := bindings[name]; soapAction != "urn:"+service+".wsapi.broadon.com/"+name {
+					t.Errorf("%s is bound to SOAPAction %q", name, soapAction)
+				}
+			}
+			if described != len(wsdl.Operations) || described != len(wsdl.Bindings) {
+				t.Errorf("%d actions are registered, but %d operations and %d bindings described", described, len(wsdl.Operations), len(wsdl.Bindings))
+			}
+		})
+	}
+}
+
+func TestWSDLWithoutActions(t *testing.T) {
+	setupTestServer(t)
+	route := newServiceRoute()
+
+	for _, service := range []string{"cas", "nus"} {
+		recorder := httptest.NewRecorder()
+		route.Handle().ServeHTTP(recorder, httptest.NewRequest("GET", "/"+service+"/services/"+services[service]+"SOAP?wsdl", nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("%s gave status %d, expected %d", service, recorder.Code, http.StatusNotFound)
+		}
+	}
+}